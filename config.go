@@ -0,0 +1,737 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/buger/gor/listener"
+	"github.com/buger/gor/replay"
+)
+
+// Config file describes both modes, only section for current mode is applied.
+// In standalone mode "ip", "port" and "protocol" are taken from "listen" section, everything else from "replay" one:
+//
+//     {
+//       "listen": {"ip": "0.0.0.0", "port": 80, "replay_address": "replay.local:28020", "replay_limit": 100},
+//       "replay": {
+//         "ip": "0.0.0.0",
+//         "port": 28020,
+//         "forward": [
+//           {"url": "http://staging.server", "limit": 10, "redirects": 3, "redirects_same_host": true},
+//           {"url": "https://dev.server", "limit": 5, "tls_ca": "dev-ca.crt", "tls_server_name": "dev.internal"},
+//           {"url": "http://qa.server", "rewrite_host": true, "mark_replayed": true, "x_forwarded": true, "clients": ["10.0.0.0/8"], "map_cookies": true}
+//         ],
+//         "drain_timeout": "10s",
+//         "summary": "summary.json",
+//         "admin": "localhost:28021",
+//         "affinity": "cookie:session_id"
+//       }
+//     }
+//
+// Same structure can be written in YAML (.yml, .yaml) or TOML (.toml).
+// Flags passed in command line override values from file.
+type fileConfig struct {
+	Listen listenConfig `json:"listen"`
+	Replay replayConfig `json:"replay"`
+}
+
+type listenConfig struct {
+	Address       string   `json:"ip"`
+	Port          int      `json:"port"`
+	ReplayAddress string   `json:"replay_address"`
+	ReplayLimit   int      `json:"replay_limit"`
+	Protocol      string   `json:"protocol"`
+	DrainTimeout  duration `json:"drain_timeout"`
+	TLS           bool     `json:"tls"`
+	TLSCA         string   `json:"tls_ca"`
+	TLSCert       string   `json:"tls_cert"`
+	TLSKey        string   `json:"tls_key"`
+	AuthSecret    string   `json:"auth_secret"`
+	Verbose       bool     `json:"verbose"`
+}
+
+type replayConfig struct {
+	Host         string          `json:"ip"`
+	Port         int             `json:"port"`
+	Forward      []forwardConfig `json:"forward"`
+	DrainTimeout duration        `json:"drain_timeout"`
+	Summary      string          `json:"summary"`
+	DryRun       bool            `json:"dry_run"`
+	DryRunOutput string          `json:"dry_run_output"`
+	Admin        string          `json:"admin"`
+	AdminToken   string          `json:"admin_token"`
+	TLSCert      string          `json:"tls_cert"`
+	TLSKey       string          `json:"tls_key"`
+	TLSClientCA  string          `json:"tls_client_ca"`
+	AuthSecret   string          `json:"auth_secret"`
+	Verbose      bool            `json:"verbose"`
+
+	MaxMessageSize int      `json:"max_message_size"`
+	Affinity       string   `json:"affinity"`
+	AffinityWindow duration `json:"affinity_window"`
+}
+
+type forwardConfig struct {
+	Url   string `json:"url"`
+	Limit int    `json:"limit"`
+
+	TLSInsecure   bool   `json:"tls_insecure"`
+	TLSCA         string `json:"tls_ca"`
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	TLSServerName string `json:"tls_server_name"`
+
+	Redirects         int  `json:"redirects"`
+	RedirectsSameHost bool `json:"redirects_same_host"`
+
+	RewriteHost  bool `json:"rewrite_host"`
+	MarkReplayed bool `json:"mark_replayed"`
+	XForwarded   bool `json:"x_forwarded"`
+	Dechunk      bool `json:"dechunk"`
+
+	Clients []string `json:"clients"`
+
+	MapCookies bool `json:"map_cookies"`
+	HTTP2      bool `json:"http2"`
+	WebSocket  bool `json:"websocket"`
+
+	DropCommands []string `json:"drop_commands"`
+	RewriteKeys  string   `json:"rewrite_keys"`
+
+	GRPCMethods []string `json:"grpc_methods"`
+}
+
+// duration accepts strings like "5s" or "1m30s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("should be a duration string, like \"5s\"")
+	}
+
+	v, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+
+	return nil
+}
+
+// configError points to the place in config file where problem found
+type configError struct {
+	file string
+	line int    // 0 if unknown
+	text string // Source line
+	path string // e.g. replay.forward[1].url
+	msg  string
+}
+
+func (e *configError) Error() string {
+	pos := e.file
+
+	if e.line > 0 {
+		pos += ":" + strconv.Itoa(e.line)
+	}
+
+	if e.path != "" {
+		pos += ": " + e.path
+	}
+
+	msg := pos + ": " + e.msg
+
+	if e.text != "" {
+		msg += "\n\t" + strings.TrimSpace(e.text)
+	}
+
+	return msg
+}
+
+// loadConfig applies section of config file for given mode to listener.Settings or replay.Settings, both for "standalone"
+//
+// Flags explicitly passed in command line are applied again, so they override file values.
+func loadConfig(path string, mode string) error {
+	return applyConfigFlags(flag.CommandLine, path, mode, &listener.Settings, &replay.Settings)
+}
+
+// applyConfigFlags applies config file to settings bound to flags, then flags set explicitly are applied again
+func applyConfigFlags(flags *flag.FlagSet, path string, mode string, listenerSettings *listener.ListenerSettings, replaySettings *replay.ReplaySettings) error {
+	// Values are taken before file overwrites settings flags bound to
+	explicit := make(map[string]string)
+
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if err := applyConfig(path, mode, listenerSettings, replaySettings); err != nil {
+		return err
+	}
+
+	// Command line flags have priority over config file
+	for name, value := range explicit {
+		flags.Set(name, value)
+
+		// Hosts passed with "-f" replace ones from file
+		if name == "f" {
+			replaySettings.Hosts = nil
+		}
+	}
+
+	return nil
+}
+
+// reloadConfig returns replay settings from config file and command line flags, global settings are not changed
+func reloadConfig(path string) (settings replay.ReplaySettings, err error) {
+	// Flags bound to local settings, so they are set to defaults as on start
+	flags := flag.NewFlagSet(mode, flag.ContinueOnError)
+	replay.RegisterFlags(flags, &settings, mode == "standalone")
+
+	if err = applyConfig(path, "replay", &listener.ListenerSettings{}, &settings); err != nil {
+		return
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if flags.Lookup(f.Name) == nil {
+			return
+		}
+
+		flags.Set(f.Name, f.Value.String())
+
+		if f.Name == "f" {
+			settings.Hosts = nil
+		}
+	})
+
+	return
+}
+
+// applyConfig applies section of config file for given mode to given settings
+func applyConfig(path string, mode string, listenerSettings *listener.ListenerSettings, replaySettings *replay.ReplaySettings) error {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	cfg := fileConfig{
+		Listen: listenConfig{
+			Address:       listenerSettings.Address,
+			Port:          listenerSettings.Port,
+			ReplayAddress: listenerSettings.ReplayAddress,
+			ReplayLimit:   listenerSettings.ReplayLimit,
+			Protocol:      listenerSettings.Protocol,
+			DrainTimeout:  duration(listenerSettings.DrainTimeout),
+			TLS:           listenerSettings.TLS,
+			TLSCA:         listenerSettings.TLSCA,
+			TLSCert:       listenerSettings.TLSCert,
+			TLSKey:        listenerSettings.TLSKey,
+			AuthSecret:    listenerSettings.AuthSecret,
+			Verbose:       listenerSettings.Verbose,
+		},
+		Replay: replayConfig{
+			Host:         replaySettings.Host,
+			Port:         replaySettings.Port,
+			DrainTimeout: duration(replaySettings.DrainTimeout),
+			Summary:      replaySettings.SummaryPath,
+			DryRun:       replaySettings.DryRun,
+			DryRunOutput: replaySettings.DryRunOutput,
+			Admin:        replaySettings.AdminAddress,
+			AdminToken:   replaySettings.AdminToken,
+			TLSCert:      replaySettings.TLSCert,
+			TLSKey:       replaySettings.TLSKey,
+			TLSClientCA:  replaySettings.TLSClientCA,
+			AuthSecret:   replaySettings.AuthSecret,
+			Verbose:      replaySettings.Verbose,
+
+			MaxMessageSize: replaySettings.MaxMessageSize,
+			Affinity:       string(replaySettings.Affinity),
+			AffinityWindow: duration(replaySettings.AffinityWindow),
+		},
+	}
+
+	if err = parseConfig(path, data, &cfg); err != nil {
+		return err
+	}
+
+	switch mode {
+	case "listen":
+		listenerSettings.Address = cfg.Listen.Address
+		listenerSettings.Port = cfg.Listen.Port
+		listenerSettings.ReplayAddress = cfg.Listen.ReplayAddress
+		listenerSettings.ReplayLimit = cfg.Listen.ReplayLimit
+		listenerSettings.Protocol = cfg.Listen.Protocol
+		listenerSettings.DrainTimeout = time.Duration(cfg.Listen.DrainTimeout)
+		listenerSettings.TLS = cfg.Listen.TLS
+		listenerSettings.TLSCA = cfg.Listen.TLSCA
+		listenerSettings.TLSCert = cfg.Listen.TLSCert
+		listenerSettings.TLSKey = cfg.Listen.TLSKey
+		listenerSettings.AuthSecret = cfg.Listen.AuthSecret
+		listenerSettings.Verbose = cfg.Listen.Verbose
+	case "replay":
+		applyReplayConfig(replaySettings, cfg.Replay)
+	case "standalone":
+		listenerSettings.Address = cfg.Listen.Address
+		listenerSettings.Port = cfg.Listen.Port
+		listenerSettings.Protocol = cfg.Listen.Protocol
+
+		applyReplayConfig(replaySettings, cfg.Replay)
+	}
+
+	return nil
+}
+
+// applyReplayConfig sets settings from "replay" section of config file
+func applyReplayConfig(s *replay.ReplaySettings, c replayConfig) {
+	s.Host = c.Host
+	s.Port = c.Port
+	s.DrainTimeout = time.Duration(c.DrainTimeout)
+	s.SummaryPath = c.Summary
+	s.DryRun = c.DryRun
+	s.DryRunOutput = c.DryRunOutput
+	s.AdminAddress = c.Admin
+	s.AdminToken = c.AdminToken
+	s.TLSCert = c.TLSCert
+	s.TLSKey = c.TLSKey
+	s.TLSClientCA = c.TLSClientCA
+	s.AuthSecret = c.AuthSecret
+	s.MaxMessageSize = c.MaxMessageSize
+	s.Verbose = c.Verbose
+	s.Affinity = replay.Affinity(c.Affinity)
+	s.AffinityWindow = time.Duration(c.AffinityWindow)
+
+	if len(c.Forward) > 0 {
+		// Hosts from file replace default "-f" value, but not the one passed explicitly
+		s.ForwardAddress = ""
+		s.Hosts = nil
+
+		for _, f := range c.Forward {
+			host := &replay.ForwardHost{Url: f.Url, Limit: f.Limit}
+			host.TLS = replay.ForwardTLS{
+				InsecureSkipVerify: f.TLSInsecure,
+				CA:                 f.TLSCA,
+				Cert:               f.TLSCert,
+				Key:                f.TLSKey,
+				ServerName:         f.TLSServerName,
+			}
+			host.Redirects = replay.RedirectPolicy{Max: f.Redirects, SameHost: f.RedirectsSameHost}
+			host.Headers = replay.HeaderOptions{RewriteHost: f.RewriteHost, MarkReplayed: f.MarkReplayed, Forwarded: f.XForwarded, Dechunk: f.Dechunk}
+			host.Clients = f.Clients
+			host.MapCookies = f.MapCookies
+			host.HTTP2 = f.HTTP2
+			host.WebSocket = f.WebSocket
+			host.Commands = replay.CommandOptions{Drop: f.DropCommands, RewriteKeys: f.RewriteKeys}
+			host.GRPCMethods = f.GRPCMethods
+
+			s.Hosts = append(s.Hosts, host)
+		}
+	}
+}
+
+// parseConfig decodes JSON, YAML or TOML (chosen by file extension) into cfg and validates it
+func parseConfig(path string, data []byte, cfg *fileConfig) error {
+	var raw interface{}
+	var lines map[string]int // Line number of each key, for JSON and YAML
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.Unmarshal(data, &raw); err != nil {
+			if syntaxErr, ok := err.(*json.SyntaxError); ok {
+				line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+				return newConfigError(path, data, line, "", err.Error())
+			}
+
+			return &configError{file: path, msg: err.Error()}
+		}
+
+		// JSON is YAML too, so YAML decoder provides key positions
+		var node yaml.Node
+		lines = make(map[string]int)
+
+		if yaml.Unmarshal(data, &node) == nil {
+			yamlLines(&node, "", lines)
+		}
+	case ".yml", ".yaml":
+		var node yaml.Node
+
+		// yaml errors already contain line numbers
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return &configError{file: path, msg: err.Error()}
+		}
+
+		if err := node.Decode(&raw); err != nil {
+			return &configError{file: path, msg: err.Error()}
+		}
+
+		lines = make(map[string]int)
+		yamlLines(&node, "", lines)
+	case ".toml":
+		var table map[string]interface{}
+
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			var parseErr toml.ParseError
+
+			if errors.As(err, &parseErr) {
+				return newConfigError(path, data, parseErr.Position.Line, "", parseErr.Message)
+			}
+
+			return &configError{file: path, msg: err.Error()}
+		}
+
+		raw = table
+	default:
+		return &configError{file: path, msg: "unknown config format, use .json, .yaml, .yml or .toml"}
+	}
+
+	errorAt := func(field string, msg string) error {
+		if lines == nil {
+			return newConfigError(path, data, tomlLine(data, field), field, msg)
+		}
+
+		return newConfigError(path, data, lineOf(lines, field), field, msg)
+	}
+
+	// Everything is converted to JSON, so all formats share decoding and validation
+	normalized, err := json.Marshal(raw)
+
+	if err != nil {
+		return &configError{file: path, msg: err.Error()}
+	}
+
+	// Decoders use different types for arrays, e.g. TOML arrays of tables are []map[string]interface{}
+	if err = json.Unmarshal(normalized, &raw); err != nil {
+		return &configError{file: path, msg: err.Error()}
+	}
+
+	if err := checkKeys(raw, reflect.TypeOf(*cfg), ""); err != nil {
+		return errorAt(err.path, err.msg)
+	}
+
+	if err = json.Unmarshal(normalized, cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+
+		if errors.As(err, &typeErr) {
+			return errorAt(fieldPath(typeErr.Field), "should be "+typeErr.Type.String()+", got "+typeErr.Value)
+		}
+
+		return &configError{file: path, msg: err.Error()}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return errorAt(err.path, err.msg)
+	}
+
+	return nil
+}
+
+func newConfigError(file string, data []byte, line int, path string, msg string) *configError {
+	err := &configError{file: file, line: line, path: path, msg: msg}
+
+	if lines := strings.Split(string(data), "\n"); line > 0 && line <= len(lines) {
+		err.text = lines[line-1]
+	}
+
+	return err
+}
+
+// lineOf finds line of given key. Decoding errors have no array indexes in path, so first matching element is used.
+// For missing keys line of parent object is returned.
+func lineOf(lines map[string]int, path string) int {
+	for path != "" {
+		if line, ok := lines[path]; ok {
+			return line
+		}
+
+		line := 0
+
+		for key, l := range lines {
+			if stripIndexes(key) == path && (line == 0 || l < line) {
+				line = l
+			}
+		}
+
+		if line > 0 {
+			return line
+		}
+
+		path = path[:strings.LastIndexAny(path, ".[")+1]
+		path = strings.TrimRight(path, ".[")
+	}
+
+	return 0
+}
+
+// fieldPath converts field of decoding error, e.g. "replay.forward.0.limit", to "replay.forward[0].limit"
+func fieldPath(field string) string {
+	parts := strings.Split(field, ".")
+	path := ""
+
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			path += "[" + part + "]"
+		} else {
+			path = strings.TrimPrefix(path+"."+part, ".")
+		}
+	}
+
+	return path
+}
+
+func stripIndexes(path string) string {
+	var b strings.Builder
+	skip := false
+
+	for _, c := range path {
+		switch {
+		case c == '[':
+			skip = true
+		case c == ']':
+			skip = false
+		case !skip:
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+// fieldError is validation error not yet bound to file position
+type fieldError struct {
+	path string
+	msg  string
+}
+
+func (c *fileConfig) validate() *fieldError {
+	if c.Listen.Port < 0 || c.Listen.Port > 65535 {
+		return &fieldError{"listen.port", "should be between 0 and 65535"}
+	}
+
+	if c.Listen.ReplayLimit < 0 {
+		return &fieldError{"listen.replay_limit", "should not be negative"}
+	}
+
+	if p := c.Listen.Protocol; p != "" && p != "http" && p != "tcp" {
+		return &fieldError{"listen.protocol", "should be http or tcp"}
+	}
+
+	if c.Replay.Port < 0 || c.Replay.Port > 65535 {
+		return &fieldError{"replay.port", "should be between 0 and 65535"}
+	}
+
+	if c.Replay.MaxMessageSize < 0 {
+		return &fieldError{"replay.max_message_size", "should not be negative"}
+	}
+
+	if (c.Replay.TLSCert == "") != (c.Replay.TLSKey == "") {
+		return &fieldError{"replay.tls_cert", "should be set together with tls_key"}
+	}
+
+	if c.Replay.TLSClientCA != "" && c.Replay.TLSCert == "" {
+		return &fieldError{"replay.tls_client_ca", "requires tls_cert and tls_key"}
+	}
+
+	if err := replay.Affinity(c.Replay.Affinity).Validate(); err != nil {
+		return &fieldError{"replay.affinity", "should be ip, cookie:<name> or header:<name>"}
+	}
+
+	for i, f := range c.Replay.Forward {
+		path := "replay.forward[" + strconv.Itoa(i) + "]"
+
+		if f.Url == "" {
+			return &fieldError{path + ".url", "should not be empty"}
+		}
+
+		if strings.ContainsAny(f.Url, ",|") {
+			return &fieldError{path + ".url", "should not contain ',' or '|', use \"limit\" field for rate limiting"}
+		}
+
+		if f.Limit < 0 {
+			return &fieldError{path + ".limit", "should not be negative"}
+		}
+
+		if f.Redirects < 0 {
+			return &fieldError{path + ".redirects", "should not be negative"}
+		}
+
+		for _, client := range f.Clients {
+			if _, _, err := net.ParseCIDR(client); err != nil && net.ParseIP(client) == nil {
+				return &fieldError{path + ".clients", "should contain IPs or networks like 10.0.0.0/8"}
+			}
+		}
+
+		if (f.TLSCert == "") != (f.TLSKey == "") {
+			return &fieldError{path + ".tls_cert", "should be set together with tls_key"}
+		}
+
+		if err := (replay.CommandOptions{RewriteKeys: f.RewriteKeys}).Validate(); err != nil {
+			return &fieldError{path + ".rewrite_keys", "should be in \"from=to\" format"}
+		}
+	}
+
+	return nil
+}
+
+// checkKeys reports keys which are not defined in config structure, usually typos
+func checkKeys(raw interface{}, t reflect.Type, path string) *fieldError {
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+
+		for key, value := range v {
+			keyPath := strings.TrimPrefix(path+"."+key, ".")
+			field, ok := fieldByTag(t, key)
+
+			if !ok {
+				return &fieldError{keyPath, "unknown option"}
+			}
+
+			if err := checkKeys(value, field.Type, keyPath); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+
+		for i, value := range v {
+			if err := checkKeys(value, t.Elem(), path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func fieldByTag(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == key {
+			return t.Field(i), true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// yamlLines walks YAML document and stores line number for every key
+func yamlLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			yamlLines(n, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := strings.TrimPrefix(path+"."+node.Content[i].Value, ".")
+			lines[keyPath] = node.Content[i].Line
+
+			yamlLines(node.Content[i+1], keyPath, lines)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			itemPath := path + "[" + strconv.Itoa(i) + "]"
+			lines[itemPath] = n.Line
+
+			yamlLines(n, itemPath, lines)
+		}
+	}
+}
+
+// tomlLine returns line where value at path is defined, 0 if not found
+//
+// TOML decoder reports positions only for syntax errors, so document is decoded line by line until
+// the value appears. Path is the same as for lineOf: without array indexes first element is used,
+// for missing keys line of parent is returned.
+func tomlLine(data []byte, path string) int {
+	lines := strings.SplitAfter(string(data), "\n")
+
+	for path != "" {
+		for n := 1; n <= len(lines); n++ {
+			var prefix map[string]interface{}
+
+			if _, err := toml.Decode(strings.Join(lines[:n], ""), &prefix); err == nil && hasPath(prefix, path) {
+				return n
+			}
+		}
+
+		path = path[:strings.LastIndexAny(path, ".[")+1]
+		path = strings.TrimRight(path, ".[")
+	}
+
+	return 0
+}
+
+// hasPath returns true if decoded document has value at path like "replay.forward[1].url"
+func hasPath(raw interface{}, path string) bool {
+	if path == "" {
+		return true
+	}
+
+	key, rest, _ := strings.Cut(path, ".")
+	index := -1
+
+	if i := strings.IndexByte(key, '['); i >= 0 {
+		index, _ = strconv.Atoi(strings.TrimSuffix(key[i+1:], "]"))
+		key = key[:i]
+	}
+
+	table, ok := raw.(map[string]interface{})
+
+	if !ok {
+		return false
+	}
+
+	value, ok := table[key]
+
+	if !ok {
+		return false
+	}
+
+	// Arrays of tables are decoded as []map[string]interface{}, other arrays as []interface{}
+	var elements []interface{}
+
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		for _, e := range v {
+			elements = append(elements, e)
+		}
+	case []interface{}:
+		elements = v
+	default:
+		return index < 0 && hasPath(value, rest)
+	}
+
+	if index >= 0 {
+		return index < len(elements) && hasPath(elements[index], rest)
+	}
+
+	if rest == "" {
+		return true
+	}
+
+	for _, e := range elements {
+		if hasPath(e, rest) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/gor/listener"
+	"github.com/buger/gor/replay"
+)
+
+func TestParseConfig(t *testing.T) {
+	configs := map[string]string{
+		"gor.json": `{
+  "replay": {
+    "port": 28021,
+    "forward": [{"url": "http://staging", "limit": 10}, {"url": "http://dev"}],
+    "drain_timeout": "10s"
+  }
+}`,
+		"gor.yaml": `
+replay:
+  port: 28021
+  forward:
+    - url: http://staging
+      limit: 10
+    - url: http://dev
+  drain_timeout: 10s
+`,
+		"gor.toml": `
+[replay]
+port = 28021
+drain_timeout = "10s"
+
+[[replay.forward]]
+url = "http://staging"
+limit = 10
+
+[[replay.forward]]
+url = "http://dev"
+`,
+	}
+
+	for path, data := range configs {
+		cfg := fileConfig{}
+
+		if err := parseConfig(path, []byte(data), &cfg); err != nil {
+			t.Error(path, err)
+			continue
+		}
+
+		if cfg.Replay.Port != 28021 || len(cfg.Replay.Forward) != 2 || cfg.Replay.Forward[0].Limit != 10 {
+			t.Error(path, "Wrong replay settings", cfg.Replay)
+		}
+
+		if time.Duration(cfg.Replay.DrainTimeout) != 10*time.Second {
+			t.Error(path, "Wrong drain timeout", cfg.Replay.DrainTimeout)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		path string
+		data string
+		err  string
+	}{
+		{"gor.json", "{\n  \"replay\": {\n    \"port\": 28020,\n  }\n}", "gor.json:4:"},
+		{"gor.json", "{\n  \"replay\": {\n    \"prot\": 28020\n  }\n}", "gor.json:3: replay.prot: unknown option"},
+		{"gor.json", "{\n  \"replay\": {\n    \"port\": \"abc\"\n  }\n}", "gor.json:3: replay.port: should be int"},
+		{"gor.json", "{\n\t\"replay\": {\n\t\t\"prot\": 28020\n\t}\n}", "gor.json:3: replay.prot: unknown option"},
+		{"gor.json", "{\"replay\": {\"forward\": [\n  {\"url\": \"http://staging\"},\n  {\"limit\": 10}\n]}}", "gor.json:3: replay.forward[1].url: should not be empty"},
+		{"gor.yaml", "replay:\n  forward:\n    - url: http://staging\n      limit: -1\n", "gor.yaml:4: replay.forward[0].limit: should not be negative"},
+		{"gor.yaml", "replay:\n  forward:\n    - url: http://staging\n      clients: [10.0.0.0/8, staging]\n", "gor.yaml:4: replay.forward[0].clients: should contain IPs"},
+		{"gor.toml", "[replay]\naffinity = \"session\"\n", "gor.toml:2: replay.affinity: should be"},
+		{"gor.toml", "[replay]\nport = 1\n\n[[replay.forward]]\nurl = \"http://staging\"\nclients = [\n  \"10.0.0.0/8\",\n]\n\n[[replay.forward]]\nlimit = 10\n", "gor.toml:10: replay.forward[1].url: should not be empty"},
+		{"gor.toml", "[[replay.forward]]\nurl = \"http://staging\"\n\n[[replay.forward]]\nurl = \"http://dev\"\nlimit = -1\n", "gor.toml:6: replay.forward[1].limit: should not be negative"},
+		{"gor.toml", "[replay]\nport = 1\nsummary = \"\"\"\nsummary.json\n\"\"\"\n\n[[replay.forward]]\nurl = \"http://dev\"\nlimt = 10\n", "gor.toml:9: replay.forward[0].limt: unknown option"},
+		{"gor.toml", "[replay]\n\n[[replay.forward]]\nurl = \"http://dev\"\nlimit = \"ten\"\n", "gor.toml:5: replay.forward[0].limit: should be int"},
+		{"gor.toml", "[replay]\nport = 1\nadmin = \n", "gor.toml:3: expected value"},
+		{"gor.yaml", "replay:\n  forward:\n    - url: redis://staging:6379\n      rewrite_keys: staging\n", "gor.yaml:4: replay.forward[0].rewrite_keys: should be"},
+		{"gor.yaml", "listen:\n  protocol: redis\n", "gor.yaml:2: listen.protocol: should be http or tcp"},
+		{"gor.ini", "", "unknown config format"},
+	}
+
+	for _, tt := range tests {
+		err := parseConfig(tt.path, []byte(tt.data), &fileConfig{})
+
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Expected error %q, got: %v", tt.err, err)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gor.yaml")
+	os.WriteFile(path, []byte("replay:\n  forward:\n    - url: http://staging\n      limit: 10\n"), 0644)
+
+	settings, err := reloadConfig(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(settings.Hosts) != 1 || settings.Hosts[0].Url != "http://staging" || settings.Hosts[0].Limit != 10 {
+		t.Error("Hosts should be loaded from file", settings.Hosts)
+	}
+
+	// Values not in file are defaults
+	if settings.AffinityWindow != 100*time.Millisecond {
+		t.Error("Default flag values should be used", settings.AffinityWindow)
+	}
+
+	if len(replay.Settings.Hosts) != 0 {
+		t.Error("Global settings should not be changed", replay.Settings.Hosts)
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gor.yaml")
+	os.WriteFile(path, []byte("replay:\n  port: 28021\n  affinity: ip\n  forward:\n    - url: http://staging\n"), 0644)
+
+	var settings replay.ReplaySettings
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	replay.RegisterFlags(flags, &settings, false)
+
+	if err := flags.Parse([]string{"-p", "28030", "-f", "http://dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyConfigFlags(flags, path, "replay", &listener.ListenerSettings{}, &settings); err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.Port != 28030 {
+		t.Error("Flag should override file value", settings.Port)
+	}
+
+	if settings.Affinity != "ip" {
+		t.Error("File value should be used if flag is not set", settings.Affinity)
+	}
+
+	if settings.ForwardAddress != "http://dev" || len(settings.Hosts) != 0 {
+		t.Error("Hosts from -f flag should replace ones from file", settings.ForwardAddress, settings.Hosts)
+	}
+}
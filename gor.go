@@ -3,14 +3,19 @@
 //
 // Gor consists of 2 parts: listener and replay servers.
 // Listener catch http traffic from given port in real-time and send it to replay server via UDP. Replay server forwards traffic to given address.
+// In standalone mode both run in one process, see standalone.go.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/buger/gor/listener"
@@ -25,13 +30,14 @@ var (
 	mode       string
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile = flag.String("memprofile", "", "write memory profile to this file")
+	configFile = flag.String("config", "", "read settings from JSON, YAML or TOML file. Command line flags override file values")
 )
 
 func main() {
 	defer func() {
 		if r := recover(); r != nil {
 			if _, ok := r.(error); !ok {
-				fmt.Errorf("pkg: %v", r)
+				log.Printf("pkg: %v", r)
 			}
 		}
 	}()
@@ -42,8 +48,8 @@ func main() {
 		mode = os.Args[1]
 	}
 
-	if mode != "listen" && mode != "replay" {
-		fmt.Println("Usage: \n\tgor listen -h\n\tgor replay -h")
+	if mode != "listen" && mode != "replay" && mode != "standalone" {
+		fmt.Println("Usage: \n\tgor listen -h\n\tgor replay -h\n\tgor standalone -h")
 		return
 	}
 
@@ -52,6 +58,105 @@ func main() {
 
 	flag.Parse()
 
+	if *configFile != "" {
+		if err := loadConfig(*configFile, mode); err != nil {
+			log.Fatal("Invalid config: ", err)
+		}
+	}
+
+	stopProfiling := profile()
+
+	// Stop accepting new traffic on SIGINT or SIGTERM, and wait for in-flight messages
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+
+	switch mode {
+	case "listen":
+		err = runListener(ctx)
+	case "replay":
+		err = runReplay(ctx)
+	case "standalone":
+		err = runStandalone(ctx)
+	}
+
+	// Profiles should be written even if we stopped earlier than 60 seconds
+	stopProfiling()
+
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func runListener(ctx context.Context) error {
+	l, err := listener.New(listener.Settings)
+
+	if err != nil {
+		return err
+	}
+
+	return l.Run(ctx)
+}
+
+func runReplay(ctx context.Context) error {
+	settings := replay.Settings
+	server, err := replay.NewServer(settings)
+
+	if err != nil {
+		return err
+	}
+
+	stopReload := reloadOnSignal(server)
+	defer stopReload()
+
+	err = server.Run(ctx)
+
+	server.Summary().Report(settings.SummaryPath)
+
+	return err
+}
+
+// reloadOnSignal reloads forward hosts of server from config file on SIGHUP
+func reloadOnSignal(server *replay.Server) (stop func()) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	go func() {
+		for range reload {
+			if *configFile == "" {
+				log.Println("Nothing to reload, start with -config to enable reload")
+				continue
+			}
+
+			settings, err := reloadConfig(*configFile)
+
+			if err != nil {
+				log.Println("Config not reloaded:", err)
+				continue
+			}
+
+			if err := server.Reload(settings); err != nil {
+				log.Println("Config not reloaded:", err)
+				continue
+			}
+
+			log.Println("Config reloaded:", *configFile)
+		}
+	}()
+
+	return func() {
+		signal.Stop(reload)
+	}
+}
+
+// profile starts cpu and memory profiling if needed, and stops it after 60 seconds
+// Returned function stops profiling immediately, it is safe to call it multiple times
+func profile() (stop func()) {
+	var once sync.Once
+	var stopFuncs []func()
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -59,10 +164,10 @@ func main() {
 		}
 		pprof.StartCPUProfile(f)
 
-		time.AfterFunc(60*time.Second, func() {
+		stopFuncs = append(stopFuncs, func() {
 			pprof.StopCPUProfile()
 			f.Close()
-			log.Println("Stop profiling after 60 seconds")
+			log.Println("Stop profiling")
 		})
 	}
 
@@ -71,16 +176,22 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		time.AfterFunc(60*time.Second, func() {
+
+		stopFuncs = append(stopFuncs, func() {
 			pprof.WriteHeapProfile(f)
 			f.Close()
 		})
 	}
 
-	switch mode {
-	case "listen":
-		listener.Run()
-	case "replay":
-		replay.Run()
+	stop = func() {
+		once.Do(func() {
+			for _, f := range stopFuncs {
+				f()
+			}
+		})
 	}
+
+	time.AfterFunc(60*time.Second, stop)
+
+	return
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -28,15 +29,30 @@ type Env struct {
 
 	ReplayLimit   int
 	ListenerLimit int
+
+	ListenerSecret string
+	ReplaySecret   string
+
+	Standalone bool // Listener passes messages to replay server in the same process
+
+	stop context.CancelFunc
 }
 
 func (e *Env) start() (p int) {
 	p = 50000 + envs*10
 
+	var ctx context.Context
+	ctx, e.stop = context.WithCancel(context.Background())
+
 	go e.startHTTP(p, http.HandlerFunc(e.ListenHandler))
 	go e.startHTTP(p+2, http.HandlerFunc(e.ReplayHandler))
-	go e.startListener(p, p+1)
-	go e.startReplay(p+1, p+2)
+
+	if e.Standalone {
+		e.startStandalone(ctx, p, p+2)
+	} else {
+		e.startListener(ctx, p, p+1)
+		e.startReplay(ctx, p+1, p+2)
+	}
 
 	// Time to start http and gor instances
 	time.Sleep(time.Millisecond * 100)
@@ -46,31 +62,72 @@ func (e *Env) start() (p int) {
 	return
 }
 
-func (e *Env) startListener(port int, replayPort int) {
-	listener.Settings.Verbose = e.Verbose
-	listener.Settings.Address = "127.0.0.1"
-	listener.Settings.ReplayAddress = "127.0.0.1:" + strconv.Itoa(replayPort)
-	listener.Settings.Port = port
+func (e *Env) startListener(ctx context.Context, port int, replayPort int) {
+	settings := listener.ListenerSettings{
+		Verbose:       e.Verbose,
+		Address:       "127.0.0.1",
+		ReplayAddress: "127.0.0.1:" + strconv.Itoa(replayPort),
+		Port:          port,
+		ReplayLimit:   e.ListenerLimit,
+		AuthSecret:    e.ListenerSecret,
+	}
+
+	l, err := listener.New(settings)
 
-	if e.ListenerLimit != 0 {
-		listener.Settings.ReplayLimit = e.ListenerLimit
+	if err != nil {
+		fmt.Println("Error while starting listener:", err)
+		return
 	}
 
-	listener.Run()
+	go l.Run(ctx)
 }
 
-func (e *Env) startReplay(port int, forwardPort int) {
-	replay.Settings.Verbose = e.Verbose
-	replay.Settings.Host = "127.0.0.1"
-	replay.Settings.Address = "127.0.0.1:" + strconv.Itoa(port)
-	replay.Settings.ForwardAddress = "127.0.0.1:" + strconv.Itoa(forwardPort)
-	replay.Settings.Port = port
+func (e *Env) startReplay(ctx context.Context, port int, forwardPort int) {
+	settings := replay.ReplaySettings{
+		Verbose:        e.Verbose,
+		Address:        "127.0.0.1:" + strconv.Itoa(port),
+		ForwardAddress: "127.0.0.1:" + strconv.Itoa(forwardPort),
+		AuthSecret:     e.ReplaySecret,
+	}
 
 	if e.ReplayLimit != 0 {
-		replay.Settings.ForwardAddress += "|" + strconv.Itoa(e.ReplayLimit)
+		settings.ForwardAddress += "|" + strconv.Itoa(e.ReplayLimit)
 	}
 
-	replay.Run()
+	server, err := replay.NewServer(settings)
+
+	if err != nil {
+		fmt.Println("Error while starting replay server:", err)
+		return
+	}
+
+	go server.Run(ctx)
+}
+
+func (e *Env) startStandalone(ctx context.Context, port int, forwardPort int) {
+	listenerSettings := listener.ListenerSettings{
+		Address:     "127.0.0.1",
+		Port:        port,
+		ReplayLimit: e.ListenerLimit,
+	}
+
+	replaySettings := replay.ReplaySettings{
+		Verbose:        e.Verbose,
+		ForwardAddress: "127.0.0.1:" + strconv.Itoa(forwardPort),
+	}
+
+	if e.ReplayLimit != 0 {
+		replaySettings.ForwardAddress += "|" + strconv.Itoa(e.ReplayLimit)
+	}
+
+	s, err := newStandalone(listenerSettings, replaySettings)
+
+	if err != nil {
+		fmt.Println("Error while starting standalone mode:", err)
+		return
+	}
+
+	go s.Run(ctx)
 }
 
 func (e *Env) startHTTP(port int, handler http.Handler) {
@@ -124,6 +181,7 @@ func TestReplay(t *testing.T) {
 		ReplayHandler: replayHandler,
 	}
 	p := env.start()
+	defer env.stop()
 
 	request = getRequest(p)
 
@@ -140,25 +198,59 @@ func TestReplay(t *testing.T) {
 	}
 }
 
+func TestStandalone(t *testing.T) {
+	var request *http.Request
+	received := make(chan *http.Request, 1)
+
+	env := &Env{
+		Standalone: true,
+		ListenHandler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "OK", http.StatusAccepted)
+		},
+		ReplayHandler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "OK", http.StatusAccepted)
+			received <- r
+		},
+	}
+	p := env.start()
+	defer env.stop()
+
+	request = getRequest(p)
+
+	if _, err := http.DefaultClient.Do(request); err != nil {
+		t.Fatal("Can't make request", err)
+	}
+
+	select {
+	case r := <-received:
+		isEqual(t, r.URL.Path, request.URL.Path)
+
+		if len(r.Cookies()) == 0 || r.Cookies()[0].Value != request.Cookies()[0].Value {
+			t.Error("Cookies should be forwarded", r.Cookies())
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout error")
+	}
+
+}
+
 func rateLimitEnv(replayLimit int, listenerLimit int, connCount int) int32 {
+	return forwardedCount(&Env{ReplayLimit: replayLimit, ListenerLimit: listenerLimit}, connCount)
+}
+
+// forwardedCount returns number of requests forwarded by env out of connCount sent at once
+func forwardedCount(env *Env, connCount int) int32 {
 	var processed int32
 
-	listenHandler := func(w http.ResponseWriter, r *http.Request) {
+	env.ListenHandler = func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "OK", http.StatusAccepted)
 	}
 
-	replayHandler := func(w http.ResponseWriter, r *http.Request) {
+	env.ReplayHandler = func(w http.ResponseWriter, r *http.Request) {
 		atomic.AddInt32(&processed, 1)
 		http.Error(w, "OK", http.StatusAccepted)
 	}
 
-	env := &Env{
-		ListenHandler: listenHandler,
-		ReplayHandler: replayHandler,
-		ReplayLimit:   replayLimit,
-		ListenerLimit: listenerLimit,
-	}
-
 	p := env.start()
 	req := getRequest(p)
 
@@ -170,7 +262,9 @@ func rateLimitEnv(replayLimit int, listenerLimit int, connCount int) int32 {
 
 	time.Sleep(time.Millisecond * 500)
 
-	return processed
+	env.stop()
+
+	return atomic.LoadInt32(&processed)
 }
 
 func TestWithoutReplayRateLimit(t *testing.T) {
@@ -196,3 +290,50 @@ func TestListenerRateLimit(t *testing.T) {
 		t.Error("It should forward only 3 requests with rate-limiting", processed)
 	}
 }
+
+func TestStandaloneReplayRateLimit(t *testing.T) {
+	processed := forwardedCount(&Env{Standalone: true, ReplayLimit: 5}, 10)
+
+	if processed != 5 {
+		t.Error("It should forward only 5 requests with rate-limiting", processed)
+	}
+}
+
+func authEnv(listenerSecret string, replaySecret string) int32 {
+	var processed int32
+
+	env := &Env{
+		ListenHandler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "OK", http.StatusAccepted)
+		},
+		ReplayHandler: func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&processed, 1)
+			http.Error(w, "OK", http.StatusAccepted)
+		},
+		ListenerSecret: listenerSecret,
+		ReplaySecret:   replaySecret,
+	}
+
+	p := env.start()
+	defer env.stop()
+
+	http.DefaultClient.Do(getRequest(p))
+
+	time.Sleep(time.Millisecond * 500)
+
+	return atomic.LoadInt32(&processed)
+}
+
+func TestAuthSecret(t *testing.T) {
+	if processed := authEnv("secret", "secret"); processed != 1 {
+		t.Error("Signed request should be forwarded", processed)
+	}
+
+	if processed := authEnv("wrong", "secret"); processed != 0 {
+		t.Error("Request with wrong signature should be rejected", processed)
+	}
+
+	if processed := authEnv("", "secret"); processed != 0 {
+		t.Error("Unsigned request should be rejected", processed)
+	}
+}
@@ -0,0 +1,35 @@
+package listener
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// signMessage prepends authentication line to the message, if AuthSecret set:
+//
+//     GOR-AUTH <unix timestamp> <hex nonce> <hex HMAC-SHA256 of timestamp, "\n", nonce, "\n" and message>\n
+//
+// Secret itself is never sent, and replay server rejects messages with old timestamps or repeated nonces.
+func (l *Listener) signMessage(data []byte) []byte {
+	if l.settings.AuthSecret == "" {
+		return data
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	nonceHex := hex.EncodeToString(nonce)
+
+	mac := hmac.New(sha256.New, []byte(l.settings.AuthSecret))
+	mac.Write([]byte(timestamp + "\n" + nonceHex + "\n"))
+	mac.Write(data)
+
+	header := "GOR-AUTH " + timestamp + " " + nonceHex + " " + hex.EncodeToString(mac.Sum(nil)) + "\n"
+
+	return append([]byte(header), data...)
+}
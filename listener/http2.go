@@ -0,0 +1,331 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP/2 cleartext (h2c) capture
+//
+// HTTP/2 connection starts with preface, either with prior knowledge or after "Upgrade: h2c" request.
+// Frames of all streams are multiplexed, and headers are compressed with state shared by the whole
+// connection, so listener keeps state per client connection, and converts each finished stream
+// into standalone HTTP/1.1 request:
+//
+//	HEADERS :method=POST :path=/api :authority=svc + DATA "a=1" + END_STREAM
+//	->
+//	POST /api HTTP/1.1\r\nHost: svc\r\nContent-Length: 3\r\n\r\na=1
+//
+// Replay server can forward these requests over HTTP/1.1 or HTTP/2, see its -forward-http2 option.
+
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Frame types and flags, https://tools.ietf.org/html/rfc7540#section-6
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRSTStream    = 0x3
+	http2FrameGoAway       = 0x7
+	http2FrameContinuation = 0x9
+
+	http2FlagEndStream  = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+var errHTTP2Frame = errors.New("malformed HTTP/2 frame")
+
+// http2Conn holds state of one client connection
+type http2Conn struct {
+	buf     []byte // Bytes of incomplete frame
+	started bool   // Connection preface received
+
+	decoder *hpack.Decoder
+	fields  []hpack.HeaderField // Decoded by decoder callback
+
+	streams map[uint32]*http2Stream
+
+	continuation *http2Stream // Stream waiting for CONTINUATION frames
+	block        []byte       // Header block fragments
+	blockEnd     bool         // END_STREAM flag of HEADERS frame
+
+	used time.Time
+}
+
+type http2Stream struct {
+	headers  []hpack.HeaderField
+	trailers []hpack.HeaderField
+	body     []byte
+}
+
+func newHTTP2Conn() *http2Conn {
+	c := &http2Conn{streams: make(map[uint32]*http2Stream)}
+
+	// Dynamic table size is limited by server SETTINGS we can't see, so allow any size client chooses
+	c.decoder = hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		c.fields = append(c.fields, f)
+	})
+	c.decoder.SetAllowedMaxDynamicTableSize(1 << 20)
+
+	return c
+}
+
+// isHTTP2 returns true if data starts HTTP/2 connection
+func isHTTP2(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(http2Preface))
+}
+
+// isHTTP1 returns true if data starts with HTTP/1.x request line
+func isHTTP1(data []byte) bool {
+	line := data
+
+	if end := bytes.IndexByte(data, '\n'); end != -1 {
+		line = data[:end]
+	}
+
+	return bytes.Contains(line, []byte(" HTTP/1."))
+}
+
+// write processes captured client bytes and returns finished requests in HTTP/1.1 format
+func (c *http2Conn) write(data []byte) (requests [][]byte, err error) {
+	c.used = time.Now()
+	c.buf = append(c.buf, data...)
+
+	if !c.started {
+		if len(c.buf) < len(http2Preface) {
+			return nil, nil
+		}
+
+		if !isHTTP2(c.buf) {
+			return nil, errHTTP2Frame
+		}
+
+		c.buf = c.buf[len(http2Preface):]
+		c.started = true
+	}
+
+	for len(c.buf) >= 9 {
+		length := int(c.buf[0])<<16 | int(c.buf[1])<<8 | int(c.buf[2])
+
+		if len(c.buf) < 9+length {
+			break
+		}
+
+		frameType := c.buf[3]
+		flags := c.buf[4]
+		streamID := binary.BigEndian.Uint32(c.buf[5:9]) & 0x7FFFFFFF
+		payload := c.buf[9 : 9+length]
+
+		request, err := c.frame(frameType, flags, streamID, payload)
+
+		if err != nil {
+			return requests, err
+		}
+
+		if request != nil {
+			requests = append(requests, request)
+		}
+
+		c.buf = c.buf[9+length:]
+	}
+
+	return
+}
+
+// frame handles single frame, returns request if stream finished
+func (c *http2Conn) frame(frameType byte, flags byte, streamID uint32, payload []byte) ([]byte, error) {
+	if c.continuation != nil && frameType != http2FrameContinuation {
+		return nil, errHTTP2Frame
+	}
+
+	switch frameType {
+	case http2FrameData:
+		payload, err := unpad(flags, payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stream, ok := c.streams[streamID]
+
+		if !ok {
+			return nil, nil
+		}
+
+		stream.body = append(stream.body, payload...)
+
+		if flags&http2FlagEndStream != 0 {
+			return c.finish(streamID), nil
+		}
+	case http2FrameHeaders:
+		payload, err := unpad(flags, payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if flags&http2FlagPriority != 0 {
+			if len(payload) < 5 {
+				return nil, errHTTP2Frame
+			}
+
+			payload = payload[5:]
+		}
+
+		stream, ok := c.streams[streamID]
+
+		if !ok {
+			stream = &http2Stream{}
+			c.streams[streamID] = stream
+		}
+
+		c.continuation = stream
+		c.block = append(c.block[:0], payload...)
+		c.blockEnd = flags&http2FlagEndStream != 0
+
+		if flags&http2FlagEndHeaders != 0 {
+			return c.endHeaders(streamID)
+		}
+	case http2FrameContinuation:
+		if c.continuation == nil {
+			return nil, errHTTP2Frame
+		}
+
+		c.block = append(c.block, payload...)
+
+		if flags&http2FlagEndHeaders != 0 {
+			return c.endHeaders(streamID)
+		}
+	case http2FrameRSTStream:
+		delete(c.streams, streamID)
+	case http2FrameGoAway:
+		// Streams already sent are still finished by client, new ones are not expected
+	}
+
+	// SETTINGS, PING, PRIORITY, WINDOW_UPDATE and unknown frames are not needed to replay requests
+	return nil, nil
+}
+
+// endHeaders decodes complete header block, second block of the stream contains trailers
+func (c *http2Conn) endHeaders(streamID uint32) ([]byte, error) {
+	stream := c.continuation
+	c.continuation = nil
+	c.fields = nil
+
+	if _, err := c.decoder.Write(c.block); err != nil {
+		return nil, err
+	}
+
+	if err := c.decoder.Close(); err != nil {
+		return nil, err
+	}
+
+	if stream.headers == nil {
+		stream.headers = c.fields
+	} else {
+		stream.trailers = c.fields
+	}
+
+	if c.blockEnd {
+		return c.finish(streamID), nil
+	}
+
+	return nil, nil
+}
+
+// finish converts stream to HTTP/1.1 request, request with trailers gets chunked body
+func (c *http2Conn) finish(streamID uint32) []byte {
+	stream := c.streams[streamID]
+	delete(c.streams, streamID)
+
+	var method, path, authority string
+	var headers, cookies []string
+
+	for _, f := range stream.headers {
+		switch f.Name {
+		case ":method":
+			method = f.Value
+		case ":path":
+			path = f.Value
+		case ":authority":
+			authority = f.Value
+		case "cookie":
+			// Cookies can be split into multiple fields, https://tools.ietf.org/html/rfc7540#section-8.1.2.5
+			cookies = append(cookies, f.Value)
+		case "te":
+			// Only "trailers" allowed in HTTP/2, gRPC servers require it
+			if f.Value == "trailers" {
+				headers = append(headers, "te: trailers")
+			}
+		case "content-length", "connection", "transfer-encoding", "trailer":
+		default:
+			if !strings.HasPrefix(f.Name, ":") {
+				headers = append(headers, f.Name+": "+f.Value)
+			}
+		}
+	}
+
+	if method == "" || path == "" {
+		return nil
+	}
+
+	request := method + " " + path + " HTTP/1.1\r\n"
+
+	if authority != "" {
+		request += "Host: " + authority + "\r\n"
+	}
+
+	for _, header := range headers {
+		request += header + "\r\n"
+	}
+
+	if len(cookies) > 0 {
+		request += "Cookie: " + strings.Join(cookies, "; ") + "\r\n"
+	}
+
+	var names, trailers []string
+
+	for _, f := range stream.trailers {
+		if !strings.HasPrefix(f.Name, ":") {
+			names = append(names, f.Name)
+			trailers = append(trailers, f.Name+": "+f.Value)
+		}
+	}
+
+	// HTTP/1.1 has trailers only in chunked body
+	if len(trailers) > 0 {
+		request += "Trailer: " + strings.Join(names, ", ") + "\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+		if len(stream.body) > 0 {
+			request += strconv.FormatInt(int64(len(stream.body)), 16) + "\r\n" + string(stream.body) + "\r\n"
+		}
+
+		return []byte(request + "0\r\n" + strings.Join(trailers, "\r\n") + "\r\n\r\n")
+	}
+
+	if len(stream.body) > 0 || method == "POST" || method == "PUT" || method == "PATCH" {
+		request += "Content-Length: " + strconv.Itoa(len(stream.body)) + "\r\n"
+	}
+
+	return append([]byte(request+"\r\n"), stream.body...)
+}
+
+// unpad removes padding of DATA and HEADERS frames
+func unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&http2FlagPadded == 0 {
+		return payload, nil
+	}
+
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, errHTTP2Frame
+	}
+
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
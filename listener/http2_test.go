@@ -0,0 +1,138 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2Client returns bytes client sends on HTTP/2 connection with two requests:
+// GET on stream 1, and POST on stream 3 with headers split by CONTINUATION, padded body and trailers
+func http2Client() []byte {
+	var buf, block bytes.Buffer
+
+	buf.WriteString(http2Preface)
+
+	framer := http2.NewFramer(&buf, nil)
+	encoder := hpack.NewEncoder(&block)
+
+	encode := func(fields ...string) []byte {
+		block.Reset()
+
+		for i := 0; i < len(fields); i += 2 {
+			encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+		}
+
+		return append([]byte(nil), block.Bytes()...)
+	}
+
+	framer.WriteSettings()
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: encode(":method", "GET", ":scheme", "http", ":path", "/get?a=1", ":authority", "svc", "cookie", "a=1", "cookie", "b=2"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+
+	headers := encode(":method", "POST", ":scheme", "http", ":path", "/post", ":authority", "svc", "content-type", "text/plain", "te", "trailers")
+	framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: headers[:5]})
+	framer.WriteContinuation(3, true, headers[5:])
+	framer.WriteDataPadded(3, false, []byte("hello "), []byte{0, 0, 0})
+	framer.WriteWindowUpdate(0, 1000)
+	framer.WriteData(3, false, []byte("world"))
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: encode("x-checksum", "42"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+
+	return buf.Bytes()
+}
+
+func TestHTTP2Conn(t *testing.T) {
+	data := http2Client()
+
+	// Connection bytes can be split between messages at any position
+	for split := 1; split < len(data); split += 7 {
+		conn := newHTTP2Conn()
+
+		first, err := conn.write(data[:split])
+
+		if err != nil {
+			t.Fatal(split, err)
+		}
+
+		second, err := conn.write(data[split:])
+
+		if err != nil {
+			t.Fatal(split, err)
+		}
+
+		requests := append(first, second...)
+
+		if len(requests) != 2 {
+			t.Fatal("Both streams should be converted to requests", split, len(requests))
+		}
+
+		get := string(requests[0])
+		post := string(requests[1])
+
+		if !strings.HasPrefix(get, "GET /get?a=1 HTTP/1.1\r\nHost: svc\r\n") || !strings.Contains(get, "Cookie: a=1; b=2\r\n") {
+			t.Errorf("Wrong GET request: %q", get)
+		}
+
+		if post != "POST /post HTTP/1.1\r\nHost: svc\r\ncontent-type: text/plain\r\nte: trailers\r\n"+
+			"Trailer: x-checksum\r\nTransfer-Encoding: chunked\r\n\r\nb\r\nhello world\r\n0\r\nx-checksum: 42\r\n\r\n" {
+			t.Errorf("Wrong POST request: %q", post)
+		}
+
+		request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(post)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body, _ := io.ReadAll(request.Body); string(body) != "hello world" || request.Trailer.Get("X-Checksum") != "42" || request.Header.Get("X-Checksum") != "" {
+			t.Error("Trailers should be sent in chunked body", string(body), request.Trailer, request.Header)
+		}
+	}
+
+	if _, err := newHTTP2Conn().write([]byte(http2Preface + "\x00\x00\x01\x01\x04\x00\x00\x00\x01\xff")); err == nil {
+		t.Error("Invalid header block should be reported")
+	}
+}
+
+func TestListenerHTTP2(t *testing.T) {
+	l := &Listener{http2: make(map[string]*http2Conn), websockets: make(map[string]*wsConn)}
+	data := http2Client()
+
+	message := func(data []byte) *TCPMessage {
+		return &TCPMessage{packets: []*TCPPacket{{Data: data, SrcIP: net.IPv4(10, 0, 0, 1), SrcPort: 51234}}}
+	}
+
+	// Upgrade request, then HTTP/2 connection
+	payloads := l.payloads(message([]byte("GET / HTTP/1.1\r\nHost: svc\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n\r\n")))
+
+	if len(payloads) != 1 || payloads[0].meta.Proto != "" {
+		t.Error("HTTP/1.1 request should be sent as is", payloads)
+	}
+
+	payloads = append(l.payloads(message(data[:40])), l.payloads(message(data[40:]))...)
+
+	if len(payloads) != 2 || payloads[1].meta.Proto != "" {
+		t.Error("HTTP/2 streams should be decoded", payloads)
+	}
+
+	// Client port reused for HTTP/1.1 connection
+	if payloads := l.payloads(message([]byte("GET / HTTP/1.1\r\nHost: svc\r\n\r\n"))); len(payloads) != 1 || len(l.http2) != 0 {
+		t.Error("New HTTP/1.1 connection should replace HTTP/2 one", payloads, len(l.http2))
+	}
+}
@@ -1,105 +1,384 @@
 // Listener capture TCP traffic using RAW SOCKETS.
 // Note: it requires sudo or root access.
 //
-// Right now it supports only HTTP
+// It supports HTTP/1.x, HTTP/2 without TLS and WebSocket. Other TCP protocols can be captured
+// with Protocol: "tcp" setting, data sent to replay server as is.
+//
+// Listener can be embedded into other programs:
+//
+//     l, err := listener.New(listener.ListenerSettings{Port: 80, Address: "0.0.0.0", ReplayAddress: "localhost:28020"})
+//     if err != nil {
+//         return err
+//     }
+//     err = l.Run(ctx) // Returns when ctx cancelled and pending messages sent
+//
+// Set Handler to receive captured messages in the same process instead of sending them to replay server.
 package listener
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
-// Debug enables logging only if "--verbose" flag passed
-func Debug(v ...interface{}) {
-	if Settings.Verbose {
+// ErrDrainTimeout returned by Run if in-flight messages was not sent during drain timeout
+var ErrDrainTimeout = errors.New("drain timeout exceeded, some messages was not sent")
+
+// HTTP/2 and WebSocket connections without traffic for this time are forgotten
+const connTTL = 5 * time.Minute
+
+// ErrProtocol returned by New if Protocol setting is unknown
+var ErrProtocol = errors.New("protocol should be \"http\" or \"tcp\"")
+
+// ErrNotRoot returned by New if process have no permissions to use RAW_SOCKET
+var ErrNotRoot = errors.New("listener should be started as root or sudo, since it sniff traffic on given port")
+
+// debug enables logging only if "--verbose" flag passed
+func debug(verbose bool, v ...interface{}) {
+	if verbose {
 		log.Println(v...)
 	}
 }
 
+// Listener captures traffic on given port and sends it to replay server
+type Listener struct {
+	settings ListenerSettings
+
+	tlsConfig *tls.Config // nil if TLS disabled
+
+	raw *RAWTCPListener
+
+	// Connections which are not plain HTTP/1.x, by client address. Owned by Run()
+	http2        map[string]*http2Conn
+	websockets   map[string]*wsConn
+	connsExpired time.Time
+
+	// Messages sent in current second for ReplayLimit. Owned by Run()
+	limitStarted time.Time
+	limitCount   int
+}
+
+// New starts capturing traffic with given settings. Captured messages are not sent until Run called.
+func New(settings ListenerSettings) (l *Listener, err error) {
+	if settings.Protocol != "" && settings.Protocol != "http" && settings.Protocol != "tcp" {
+		return nil, ErrProtocol
+	}
+
+	if os.Getuid() != 0 {
+		return nil, ErrNotRoot
+	}
+
+	if settings.DrainTimeout == 0 {
+		settings.DrainTimeout = defaultDrainTimeout
+	}
+
+	l = &Listener{settings: settings}
+	l.http2 = make(map[string]*http2Conn)
+	l.websockets = make(map[string]*wsConn)
+
+	if settings.TLS {
+		if l.tlsConfig, err = settings.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sniffing traffic from given address
+	l.raw, err = RAWTCPListen(settings.Address, settings.Port, settings.Verbose)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
 // ReplayServer returns a connection to the replay server and error if some
-func ReplayServer() (conn net.Conn, err error) {
+func (l *Listener) ReplayServer() (conn net.Conn, err error) {
 	// Connection to replay server
-	conn, err = net.Dial("tcp", Settings.ReplayAddress)
+	if l.tlsConfig != nil {
+		conn, err = tls.Dial("tcp", l.settings.ReplayAddress, l.tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", l.settings.ReplayAddress)
+	}
 
 	if err != nil {
-		log.Println("Connection error ", err, Settings.ReplayAddress)
+		log.Println("Connection error ", err, l.settings.ReplayAddress)
 	}
 
 	return
 }
 
-// Run acts as `main` function of a listener
-func Run() {
-	if os.Getuid() != 0 {
-		fmt.Println("Please start the listener as root or sudo!")
-		fmt.Println("This is required since listener sniff traffic on given port.")
-		os.Exit(1)
+// Run sends captured messages to replay server until ctx cancelled
+//
+// After cancellation it stops capturing traffic, and waits until pending messages sent to replay server.
+// Returns ErrDrainTimeout if it took longer than DrainTimeout setting.
+func (l *Listener) Run(ctx context.Context) error {
+	protocol := "HTTP"
+
+	if l.settings.Protocol == "tcp" {
+		protocol = "TCP"
 	}
 
-	fmt.Println("Listening for HTTP traffic on", Settings.Address+":"+strconv.Itoa(Settings.Port))
-	fmt.Println("Forwarding requests to replay server:", Settings.ReplayAddress, "Limit:", Settings.ReplayLimit)
+	fmt.Println("Listening for", protocol, "traffic on", l.settings.Address+":"+strconv.Itoa(l.settings.Port))
 
-	// Sniffing traffic from given address
-	listener := RAWTCPListen(Settings.Address, Settings.Port)
+	if l.settings.Handler != nil {
+		fmt.Println("Forwarding requests in-process, Limit:", l.settings.ReplayLimit)
+	} else {
+		fmt.Println("Forwarding requests to replay server:", l.settings.ReplayAddress, "Limit:", l.settings.ReplayLimit)
+	}
+
+	go func() {
+		<-ctx.Done()
+		log.Println("Stopping listener, draining pending messages")
+		l.raw.Close()
+	}()
 
-	currentTime := time.Now().UnixNano()
-	currentRPS := 0
+	var inFlight sync.WaitGroup
 
 	for {
 		// Receiving TCPMessage object
-		m := listener.Receive()
+		m := l.raw.Receive()
+
+		// Listener closed and all pending messages received
+		if m == nil {
+			break
+		}
+
+		for _, p := range l.limit(l.payloads(m)) {
+			inFlight.Add(1)
+
+			go func(p payload) {
+				l.sendMessage(p.meta, p.data)
+				inFlight.Done()
+			}(p)
+		}
+	}
+
+	if !waitTimeout(&inFlight, l.settings.DrainTimeout) {
+		return ErrDrainTimeout
+	}
 
-		if Settings.ReplayLimit != 0 {
-			if (time.Now().UnixNano() - currentTime) > time.Second.Nanoseconds() {
-				currentTime = time.Now().UnixNano()
-				currentRPS = 0
+	return nil
+}
+
+// waitTimeout returns false if WaitGroup not finished in given time
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan bool)
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	}
+
+	// Finished right at the deadline
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// limit drops HTTP requests above ReplayLimit per second
+//
+// WebSocket frames and raw TCP data are never dropped, since stream can't be replayed without some of its parts.
+// Replay server limits such streams by new client connections.
+func (l *Listener) limit(payloads []payload) (allowed []payload) {
+	if l.settings.ReplayLimit == 0 {
+		return payloads
+	}
+
+	for _, p := range payloads {
+		if p.meta.Proto == "" {
+			if time.Since(l.limitStarted) > time.Second {
+				l.limitStarted = time.Now()
+				l.limitCount = 0
 			}
 
-			if currentRPS >= Settings.ReplayLimit {
+			if l.limitCount >= l.settings.ReplayLimit {
 				continue
 			}
 
-			currentRPS++
+			l.limitCount++
 		}
 
-		go sendMessage(m)
+		allowed = append(allowed, p)
 	}
+
+	return
 }
 
-func sendMessage(m *TCPMessage) {
-	conn, err := ReplayServer()
+// payload is data sent to replay server as single message
+type payload struct {
+	meta MessageMeta
+	data []byte
+}
+
+// payloads returns what should be sent to replay server for captured message:
+// HTTP/1.x requests as is, HTTP/2 streams converted into HTTP/1.1 requests, and WebSocket frames one by one.
+// In "tcp" mode data is sent as is.
+func (l *Listener) payloads(m *TCPMessage) []payload {
+	meta := m.Meta()
+	data := m.Bytes()
+
+	if l.settings.Protocol == "tcp" {
+		meta.Proto = "tcp"
+		return []payload{{meta, data}}
+	}
+
+	key := net.JoinHostPort(meta.ClientIP.String(), strconv.Itoa(meta.ClientPort))
+
+	l.expireConns()
+
+	if ws, ok := l.websockets[key]; ok {
+		// Upgrade refused, or client port reused by new connection
+		if len(ws.buf) == 0 && isHTTP1(data) {
+			delete(l.websockets, key)
+		} else {
+			return l.websocketPayloads(key, ws, m, meta)
+		}
+	}
+
+	if conn, ok := l.http2[key]; ok || isHTTP2(data) {
+		// Client port reused by new HTTP/1.x connection
+		if ok && len(conn.buf) == 0 && isHTTP1(data) {
+			delete(l.http2, key)
+		} else {
+			return l.http2Payloads(key, data, meta)
+		}
+	}
+
+	if isWebSocketUpgrade(data) {
+		l.websockets[key] = &wsConn{used: time.Now()}
+	}
+
+	return []payload{{meta, data}}
+}
+
+func (l *Listener) http2Payloads(key string, data []byte, meta MessageMeta) (payloads []payload) {
+	conn, ok := l.http2[key]
+
+	if !ok || isHTTP2(data) {
+		conn = newHTTP2Conn()
+		l.http2[key] = conn
+	}
+
+	requests, err := conn.write(data)
 
 	if err != nil {
-		log.Println("Failed to send message. Replay server not respond.")
+		debug(l.settings.Verbose, "Error while decoding HTTP/2 connection", key, err)
+		delete(l.http2, key)
+	}
+
+	for _, request := range requests {
+		payloads = append(payloads, payload{meta, request})
+	}
+
+	return
+}
+
+// websocketPayloads returns frames with time their last packet was captured
+func (l *Listener) websocketPayloads(key string, conn *wsConn, m *TCPMessage, meta MessageMeta) (payloads []payload) {
+	meta.Proto = "websocket"
+
+	for _, packet := range m.sorted() {
+		frames, closed, err := conn.write(packet.Data)
+
+		if err != nil {
+			debug(l.settings.Verbose, "Error while decoding WebSocket connection", key, err)
+			delete(l.websockets, key)
+			return
+		}
+
+		for _, frame := range frames {
+			meta.FirstPacket = packet.Captured
+			meta.LastPacket = packet.Captured
+
+			payloads = append(payloads, payload{meta, frame})
+		}
+
+		if closed {
+			delete(l.websockets, key)
+			return
+		}
+	}
+
+	return
+}
+
+// expireConns forgets idle HTTP/2 and WebSocket connections, checked at most once a minute
+func (l *Listener) expireConns() {
+	if time.Since(l.connsExpired) < time.Minute {
 		return
-	} else {
-		defer conn.Close()
 	}
 
+	l.connsExpired = time.Now()
+
+	for key, conn := range l.http2 {
+		if time.Since(conn.used) > connTTL {
+			delete(l.http2, key)
+		}
+	}
+
+	for key, conn := range l.websockets {
+		if time.Since(conn.used) > connTTL {
+			delete(l.websockets, key)
+		}
+	}
+}
+
+// sendMessage passes message to Handler if set, or sends it to replay server
+func (l *Listener) sendMessage(meta MessageMeta, data []byte) {
 	// For debugging purpose
 	// Usually request parsing happens in replay part
-	if Settings.Verbose {
-		buf := bytes.NewBuffer(m.Bytes())
+	if l.settings.Verbose && (meta.Proto == "") {
+		buf := bytes.NewBuffer(data)
 		reader := bufio.NewReader(buf)
 
 		request, err := http.ReadRequest(reader)
 
 		if err != nil {
-			Debug("Error while parsing request:", err, string(m.Bytes()))
+			debug(l.settings.Verbose, "Error while parsing request:", err, string(data))
 		} else {
 			request.ParseMultipartForm(32 << 20)
-			Debug("Forwarding request:", request)
+			debug(l.settings.Verbose, "Forwarding request:", request)
 		}
 	}
 
-	_, err = conn.Write(m.Bytes())
+	if l.settings.Handler != nil {
+		l.settings.Handler(meta, data)
+		return
+	}
+
+	conn, err := l.ReplayServer()
+
+	if err != nil {
+		log.Println("Failed to send message. Replay server not respond.")
+		return
+	} else {
+		defer conn.Close()
+	}
+
+	_, err = conn.Write(l.signMessage(append(metaLine(meta), data...)))
 
 	if err != nil {
 		log.Println("Error while sending requests", err)
@@ -2,19 +2,78 @@ package listener
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
-	//"time"
+	"time"
 )
 
 func getTCPMessage() (msg *TCPMessage) {
-	packet1 := &TCPPacket{Data: []byte("GET /pub/WWW/ HTTP/1.1\nHost: www.w3.org\r\n\r\n")}
+	packet1 := &TCPPacket{Data: []byte("GET /pub/WWW/ HTTP/1.1\nHost: www.w3.org\r\n\r\n"), SrcIP: net.IPv4(10, 0, 0, 1)}
 	packet2 := &TCPPacket{Data: []byte("asd=asdasd&zxc=qwe\r\n\r\n")}
 
 	return &TCPMessage{packets: []*TCPPacket{packet1, packet2}}
 }
 
+func TestMessageBytesOrder(t *testing.T) {
+	// Chunked request split into packets, arrived out of order, with sequence number wraparound
+	packets := []*TCPPacket{
+		{Seq: 57, Data: []byte("5\r\nhello\r\n0\r\nX-Checksum: 1\r\n\r\n")},
+		{Seq: 0xFFFFFFF0, Data: []byte("POST / HTTP/1.1\r\nHost: www.w3.org\r\n")},
+		{Seq: 49, Data: []byte("3\r\nabc\r\n")},
+		{Seq: 19, Data: []byte("Transfer-Encoding: chunked\r\n\r\n")},
+	}
+
+	msg := &TCPMessage{packets: packets}
+	expected := "POST / HTTP/1.1\r\nHost: www.w3.org\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n5\r\nhello\r\n0\r\nX-Checksum: 1\r\n\r\n"
+
+	if string(msg.Bytes()) != expected {
+		t.Errorf("Packets should be ordered by sequence: %q", msg.Bytes())
+	}
+}
+
+func TestHTTPComplete(t *testing.T) {
+	tests := []struct {
+		data     string
+		complete bool
+		known    bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: www.w3.org\r\n", false, true},
+		{"GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n", true, true},
+		{"GET / HTTP/1.1\nHost: www.w3.org\n\n", true, true},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\na=1", false, true},
+		{"POST / HTTP/1.1\r\ncontent-length: 7\r\n\r\na=1&b=2", true, true},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\na=1&b=2GET / HTTP/1.1\r\n\r\n", true, true},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\na=1&b=2GET / HTTP/1.1\r\n", false, true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n", false, true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nab", false, true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n", false, true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", true, true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n3;ext=1\r\nabc\r\n0\r\nX-Checksum: 1\r\n", false, true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n3;ext=1\r\nabc\r\n0\r\nX-Checksum: 1\r\n\r\n", true, true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n", false, false},
+		{"POST / HTTP/1.1\r\nContent-Length: x\r\n\r\n", false, false},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", false, false},
+		{"\x81\x85\x37\xfa\x21\x3d\x7f\x9f\x4d\x51\x58", false, false},
+	}
+
+	for i, tt := range tests {
+		complete, known := httpComplete([]byte(tt.data))
+
+		if complete != tt.complete || known != tt.known {
+			t.Errorf("Case %d: expected complete %v known %v, got %v %v: %q", i, tt.complete, tt.known, complete, known, tt.data)
+		}
+	}
+}
+
 func mockServer() (replay net.Listener) {
 	replay, _ = net.Listen("tcp", "127.0.0.1:0")
 
@@ -24,15 +83,13 @@ func mockServer() (replay net.Listener) {
 }
 
 func TestSendMessage(t *testing.T) {
-	Settings.Verbose = false
-
 	replay := mockServer()
 
-	Settings.ReplayAddress = replay.Addr().String()
+	l := &Listener{settings: ListenerSettings{ReplayAddress: replay.Addr().String()}}
 
 	msg := getTCPMessage()
 
-	sendMessage(msg)
+	l.sendMessage(msg.Meta(), msg.Bytes())
 
 	conn, _ := replay.Accept()
 	defer conn.Close()
@@ -41,8 +98,10 @@ func TestSendMessage(t *testing.T) {
 	n, _ := conn.Read(buf)
 	buf = buf[0:n]
 
-	if bytes.Compare(buf, msg.Bytes()) != 0 {
-		t.Errorf("Original and received requests does not match")
+	expected := append([]byte("GOR-META client_ip=10.0.0.1\n"), msg.Bytes()...)
+
+	if bytes.Compare(buf, expected) != 0 {
+		t.Errorf("Original and received requests does not match: %q", buf)
 	}
 }
 
@@ -79,3 +138,99 @@ func TestPerformance(t *testing.T) {
 	}
 }
 */
+
+func TestSendMessageTLS(t *testing.T) {
+	// Used only for its certificate
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	replay, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	settings := ListenerSettings{ReplayAddress: replay.Addr().String(), TLS: true, TLSCA: caFile}
+	config, err := settings.tlsConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []byte, 1)
+
+	go func() {
+		conn, _ := replay.Accept()
+		defer conn.Close()
+
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	l := &Listener{settings: settings, tlsConfig: config}
+	msg := getTCPMessage()
+	l.sendMessage(msg.Meta(), msg.Bytes())
+
+	select {
+	case data := <-received:
+		if !bytes.HasSuffix(data, msg.Bytes()) {
+			t.Errorf("Wrong message received: %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("Message should be sent over TLS")
+	}
+}
+
+func TestListenerTCP(t *testing.T) {
+	l := &Listener{settings: ListenerSettings{Protocol: "tcp"}, http2: make(map[string]*http2Conn), websockets: make(map[string]*wsConn)}
+
+	// Data which looks like HTTP/2 or HTTP upgrade is not interpreted
+	for _, data := range []string{http2Preface, "GET / HTTP/1.1\r\nUpgrade: websocket\r\n\r\n", "*1\r\n$4\r\nPING\r\n"} {
+		m := &TCPMessage{packets: []*TCPPacket{{Data: []byte(data), SrcIP: net.IPv4(10, 0, 0, 1), SrcPort: 51234}}}
+		payloads := l.payloads(m)
+
+		if len(payloads) != 1 || payloads[0].meta.Proto != "tcp" || string(payloads[0].data) != data {
+			t.Error("Data should be sent as is", payloads)
+		}
+	}
+
+	if len(l.http2) != 0 || len(l.websockets) != 0 {
+		t.Error("Connections should not be tracked in tcp mode")
+	}
+
+	// Chunks of the same connection can't be dropped
+	l.settings.ReplayLimit = 1
+
+	for i := 0; i < 3; i++ {
+		m := &TCPMessage{packets: []*TCPPacket{{Data: []byte("*1\r\n$4\r\nPING\r\n"), SrcIP: net.IPv4(10, 0, 0, 1), SrcPort: 51234}}}
+
+		if payloads := l.limit(l.payloads(m)); len(payloads) != 1 {
+			t.Error("TCP data should not be limited", i, payloads)
+		}
+	}
+
+	if _, err := New(ListenerSettings{Protocol: "redis"}); err != ErrProtocol {
+		t.Error("Unknown protocol should be rejected", err)
+	}
+}
+
+func TestRunZeroDrainTimeout(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		l, err := New(ListenerSettings{Address: "127.0.0.1", Port: 50990})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := l.Run(ctx); err != nil {
+			t.Fatal("Nothing was pending, default drain timeout should be used", err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package listener
+
+import (
+	"strconv"
+	"time"
+)
+
+// metaLine describes where message came from, listener prepends it to each message:
+//
+//     GOR-META client_ip=10.0.0.1 client_port=51234 server_ip=10.0.0.2 server_port=80 first_packet=<unix nano> last_packet=<unix nano> proto=websocket\n
+//
+// Unknown values are omitted. It is added before signing, so it is covered by authentication line.
+func metaLine(meta MessageMeta) []byte {
+	line := "GOR-META"
+
+	if meta.ClientIP != nil {
+		line += " client_ip=" + meta.ClientIP.String()
+	}
+
+	if meta.ClientPort != 0 {
+		line += " client_port=" + strconv.Itoa(meta.ClientPort)
+	}
+
+	if meta.ServerIP != nil {
+		line += " server_ip=" + meta.ServerIP.String()
+	}
+
+	if meta.ServerPort != 0 {
+		line += " server_port=" + strconv.Itoa(meta.ServerPort)
+	}
+
+	line += timeField("first_packet", meta.FirstPacket)
+	line += timeField("last_packet", meta.LastPacket)
+
+	if meta.Proto != "" {
+		line += " proto=" + meta.Proto
+	}
+
+	return []byte(line + "\n")
+}
+
+func timeField(name string, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return " " + name + "=" + strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -2,8 +2,8 @@ package listener
 
 import (
 	"encoding/binary"
-	"log"
 	"net"
+	"time"
 )
 
 // Capture traffic from socket using RAW_SOCKET's
@@ -15,27 +15,48 @@ import (
 // TCP packets is parsed using tcp_packet.go, and flow control is managed by tcp_message.go
 type RAWTCPListener struct {
 	messages map[uint32]*TCPMessage // buffer of TCPMessages waiting to be send
+	pending  int                    // Messages not yet received from c_del_message, including completed ones already removed from messages
 
 	c_packets  chan *TCPPacket
 	c_messages chan *TCPMessage // Messages ready to be send to client
 
 	c_del_message chan *TCPMessage // Used for notifications about completed or expired messages
 
+	c_close chan bool // Closed when listener should stop capturing and flush pending messages
+	c_done  chan bool // Closed when all pending messages flushed
+
+	closing bool
+
+	conn *net.IPConn // RAW_SOCKET we are reading from
+
 	addr string // IP to listen
 	port int    // Port to listen
+
+	verbose bool
 }
 
 // RAWTCPListen creates a listener to capture traffic from RAW_SOCKET
-func RAWTCPListen(addr string, port int) (listener *RAWTCPListener) {
+func RAWTCPListen(addr string, port int, verbose bool) (listener *RAWTCPListener, err error) {
 	listener = &RAWTCPListener{}
 
 	listener.c_packets = make(chan *TCPPacket, 100)
 	listener.c_messages = make(chan *TCPMessage, 100)
 	listener.c_del_message = make(chan *TCPMessage, 100)
+	listener.c_close = make(chan bool)
+	listener.c_done = make(chan bool)
 	listener.messages = make(map[uint32]*TCPMessage)
 
 	listener.addr = addr
 	listener.port = port
+	listener.verbose = verbose
+
+	conn, err := net.ListenPacket("ip4:tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listener.conn = conn.(*net.IPConn)
 
 	go listener.listen()
 	go listener.readRAWSocket()
@@ -44,51 +65,119 @@ func RAWTCPListen(addr string, port int) (listener *RAWTCPListener) {
 }
 
 func (t *RAWTCPListener) listen() {
+	c_close := t.c_close
+
 	for {
 		select {
 		// If message ready for deletion it means that its also complete or expired by timeout
 		case message := <-t.c_del_message:
 			t.c_messages <- message
-			delete(t.messages, message.Ack)
+			t.pending--
+
+			// Packet with same Ack could already start new message
+			if t.messages[message.Ack] == message {
+				delete(t.messages, message.Ack)
+			}
 
 		// We need to use channels to process each packet to avoid data races
 		case packet := <-t.c_packets:
-			t.processTCPPacket(packet)
+			// After Close() we do not accept new traffic
+			if !t.closing {
+				t.processTCPPacket(packet)
+			}
+
+		case <-c_close:
+			t.closing = true
+			c_close = nil // Closed channel is always ready, so stop selecting on it
+			t.flush()
+		}
+
+		if t.closing && t.pending == 0 {
+			close(t.c_done)
+			close(t.c_messages)
+			return
 		}
 	}
 }
 
-func (t *RAWTCPListener) readRAWSocket() {
-	conn, e := net.ListenPacket("ip4:tcp", t.addr)
-	defer conn.Close()
+// flush sends all pending messages without waiting for their timeout
+func (t *RAWTCPListener) flush() {
+	// Packets captured before Close() still should be delivered
+	for len(t.c_packets) > 0 {
+		t.processTCPPacket(<-t.c_packets)
+	}
 
-	if e != nil {
-		log.Fatal(e)
+	// Expire messages right now, they will arrive via c_del_message.
+	// Messages already expired are waiting in c_del_message and ignore closed channel.
+	for _, message := range t.messages {
+		close(message.c_packets)
 	}
+}
+
+// Close stops capturing traffic. Pending messages flushed to Receive(), which returns nil after last of them.
+func (t *RAWTCPListener) Close() {
+	t.conn.Close()
+	close(t.c_close)
+}
+
+func (t *RAWTCPListener) readRAWSocket() {
+	defer t.conn.Close()
 
 	buf := make([]byte, 4096*2)
 
 	for {
-		// Note: ReadFrom receive messages without IP header
-		n, _, err := conn.ReadFrom(buf)
+		// Note: unlike ReadFrom, ReadMsgIP receive messages with IP header, we need it for destination address
+		n, _, _, _, err := t.conn.ReadMsgIP(buf, nil)
 
 		if err != nil {
-			Debug("Error:", err)
+			select {
+			case <-t.c_close:
+				return
+			default:
+			}
+
+			debug(t.verbose, "Error:", err)
 			continue
 		}
 
 		if n > 0 {
-			t.parsePacket(buf[:n])
+			t.parseIPPacket(buf[:n])
 		}
 	}
 }
 
-func (t *RAWTCPListener) parsePacket(buf []byte) {
+// parseIPPacket takes addresses from IPv4 header and passes TCP packet further
+// http://en.wikipedia.org/wiki/IPv4#Header
+func (t *RAWTCPListener) parseIPPacket(buf []byte) {
+	if len(buf) < 20 || buf[0]>>4 != 4 {
+		return
+	}
+
+	headerLen := int(buf[0]&0x0F) * 4
+
+	if len(buf) < headerLen+20 {
+		return
+	}
+
+	t.parsePacket(buf[headerLen:], net.IP(buf[12:16]), net.IP(buf[16:20]))
+}
+
+func (t *RAWTCPListener) parsePacket(buf []byte, srcIP net.IP, destIP net.IP) {
 	if t.isIncomingDataPacket(buf) {
 		new_buf := make([]byte, len(buf))
 		copy(new_buf, buf)
 
-		t.c_packets <- ParseTCPPacket(new_buf)
+		packet := ParseTCPPacket(new_buf)
+		packet.Captured = time.Now()
+
+		// Addresses point to shared read buffer, so they copied too
+		packet.SrcIP = append(net.IP(nil), srcIP...)
+		packet.DestIP = append(net.IP(nil), destIP...)
+
+		select {
+		case t.c_packets <- packet:
+		case <-t.c_done:
+		}
 	}
 }
 
@@ -117,21 +206,26 @@ func (t *RAWTCPListener) isIncomingDataPacket(buf []byte) bool {
 //
 // For TCP message unique id is Acknowledgment number (see tcp_packet.go)
 func (t *RAWTCPListener) processTCPPacket(packet *TCPPacket) {
-	var message *TCPMessage
-
-	message, ok := t.messages[packet.Ack]
-
-	if !ok {
-		// We sending c_del_message channel, so message object can communicate with Listener and notify it if message completed
-		message = NewTCPMessage(packet.Ack, t.c_del_message)
-		t.messages[packet.Ack] = message
+	if message, ok := t.messages[packet.Ack]; ok {
+		select {
+		// Adding packet to message
+		case message.c_packets <- packet:
+			return
+		// Message completed or expired, packet belongs to the next one
+		case <-message.c_done:
+		}
 	}
 
-	// Adding packet to message
+	// We sending c_del_message channel, so message object can communicate with Listener and notify it if message completed
+	message := NewTCPMessage(packet.Ack, t.c_del_message, t.verbose)
+	t.messages[packet.Ack] = message
+	t.pending++
+
 	message.c_packets <- packet
 }
 
 // Receive TCP messages from the listener channel
+// Returns nil when listener closed and all pending messages received
 func (t *RAWTCPListener) Receive() *TCPMessage {
 	return <-t.c_messages
 }
@@ -5,10 +5,14 @@ import (
 	"math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
+var clientIP, serverIP = net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
 func createHeader(ack uint32, port int) (header []byte, o_ack uint32) {
 	if ack == 0 {
 		ack = rand.Uint32()
@@ -16,7 +20,8 @@ func createHeader(ack uint32, port int) (header []byte, o_ack uint32) {
 
 	seq := rand.Uint32()
 
-	header = make([]byte, 256)
+	// Data offset is 4 words, so payload starts right after it
+	header = make([]byte, 16)
 
 	binary.BigEndian.PutUint16(header[2:4], uint16(port))
 	binary.BigEndian.PutUint32(header[4:8], seq)
@@ -35,10 +40,12 @@ func getPackets(port int) [][]byte {
 		return [][]byte{tcp}
 	} else {
 		tcp1, ack := createHeader(uint32(0), port)
-		tcp1 = append(tcp1, []byte("POST /pub/WWW/ HTTP/1.1\nHost: www.w3.org\r\n\r\n")...)
+		tcp1 = append(tcp1, []byte("POST /pub/WWW/ HTTP/1.1\nHost: www.w3.org\r\nContent-Length: 7\r\n\r\n")...)
 
+		// Body continues request, so its sequence follows first packet
 		tcp2, _ := createHeader(ack, port)
-		tcp2 = append(tcp2, []byte("a=1&b=2\r\n\r\n")...)
+		binary.BigEndian.PutUint32(tcp2[4:8], binary.BigEndian.Uint32(tcp1[4:8])+uint32(len(tcp1)-16))
+		tcp2 = append(tcp2, []byte("a=1&b=2")...)
 
 		return [][]byte{tcp1, tcp2}
 	}
@@ -46,8 +53,6 @@ func getPackets(port int) [][]byte {
 }
 
 func TestRawTCPListener(t *testing.T) {
-	Settings.Verbose = true
-
 	server := mockServer()
 	//server_addr := server.Addr().String()
 	host, port_str, _ := net.SplitHostPort(server.Addr().String())
@@ -59,7 +64,11 @@ func TestRawTCPListener(t *testing.T) {
 		conn.Close()
 	}()
 
-	listener := RAWTCPListen(host, port)
+	listener, err := RAWTCPListen(host, port, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var wg sync.WaitGroup
 
@@ -76,9 +85,166 @@ func TestRawTCPListener(t *testing.T) {
 		packets := getPackets(port)
 
 		for _, packet := range packets {
-			listener.parsePacket(packet)
+			listener.parsePacket(packet, clientIP, serverIP)
 		}
 	}
 
 	wg.Wait()
 }
+
+func TestRawTCPListenerClose(t *testing.T) {
+	server := mockServer()
+	host, port_str, _ := net.SplitHostPort(server.Addr().String())
+	port, _ := strconv.Atoi(port_str)
+
+	listener, err := RAWTCPListen(host, port, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		packet, _ := createHeader(uint32(0), port)
+		packet = append(packet, []byte("GET / HTTP/1.1\r\n\r\n")...)
+
+		listener.parsePacket(packet, clientIP, serverIP)
+	}
+
+	// Messages should be flushed without waiting for MSG_EXPIRE
+	listener.Close()
+
+	received := 0
+
+	for listener.Receive() != nil {
+		received++
+	}
+
+	if received != 10 {
+		t.Error("All pending messages should be flushed on Close", received)
+	}
+}
+
+func TestRawTCPListenerChunked(t *testing.T) {
+	server := mockServer()
+	host, port_str, _ := net.SplitHostPort(server.Addr().String())
+	port, _ := strconv.Atoi(port_str)
+
+	listener, err := RAWTCPListen(host, port, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	chunks := []string{
+		"POST / HTTP/1.1\r\nHost: www.w3.org\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"3\r\nabc\r\n",
+		"5\r\nhello\r\n",
+		"0\r\nX-Checksum: 1\r\n",
+		"\r\n",
+	}
+
+	received := make(chan *TCPMessage)
+
+	go func() {
+		received <- listener.Receive()
+	}()
+
+	header, ack := createHeader(0, port)
+	seq := binary.BigEndian.Uint32(header[4:8])
+
+	// Client sends body chunks slower than MSG_EXPIRE
+	for i, chunk := range chunks {
+		packet, _ := createHeader(ack, port)
+		binary.BigEndian.PutUint32(packet[4:8], seq)
+		seq += uint32(len(chunk))
+
+		listener.parsePacket(append(packet, chunk...), clientIP, serverIP)
+
+		if i == len(chunks)-1 {
+			break
+		}
+
+		select {
+		case m := <-received:
+			t.Fatalf("Message should be received only after last chunk and trailers: %q", m.Bytes())
+		case <-time.After(MSG_EXPIRE + 100*time.Millisecond):
+		}
+	}
+
+	// Complete message sent without waiting for MSG_EXPIRE
+	select {
+	case m := <-received:
+		if string(m.Bytes()) != strings.Join(chunks, "") {
+			t.Errorf("Message should contain all chunks: %q", m.Bytes())
+		}
+	case <-time.After(MSG_EXPIRE / 2):
+		t.Error("Message should be received right after last chunk")
+	}
+}
+
+func TestRawTCPListenerMeta(t *testing.T) {
+	server := mockServer()
+	host, port_str, _ := net.SplitHostPort(server.Addr().String())
+	port, _ := strconv.Atoi(port_str)
+
+	go func() {
+		conn, _ := server.Accept()
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	listener, err := RAWTCPListen(host, port, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	meta := listener.Receive().Meta()
+	client := conn.LocalAddr().(*net.TCPAddr)
+
+	if !meta.ClientIP.Equal(client.IP) || meta.ClientPort != client.Port {
+		t.Error("Wrong client address", meta.ClientIP, meta.ClientPort, client)
+	}
+
+	if !meta.ServerIP.Equal(net.ParseIP(host)) || meta.ServerPort != port {
+		t.Error("Wrong server address", meta.ServerIP, meta.ServerPort)
+	}
+
+	if meta.FirstPacket.IsZero() || meta.LastPacket.Before(meta.FirstPacket) {
+		t.Error("Wrong timestamps", meta.FirstPacket, meta.LastPacket)
+	}
+}
+
+func TestRawTCPListenerFlushExpired(t *testing.T) {
+	listener := &RAWTCPListener{
+		messages:      make(map[uint32]*TCPMessage),
+		c_packets:     make(chan *TCPPacket, 1),
+		c_del_message: make(chan *TCPMessage, 2),
+	}
+
+	message := NewTCPMessage(1, listener.c_del_message, false)
+	listener.messages[1] = message
+
+	// Message expired, but not yet received by listen()
+	for len(listener.c_del_message) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	listener.flush()
+	time.Sleep(50 * time.Millisecond)
+
+	if len(listener.c_del_message) != 1 {
+		t.Error("Expired message should be sent once", len(listener.c_del_message))
+	}
+}
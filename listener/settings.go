@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -12,6 +13,8 @@ const (
 	defaultAddress = "0.0.0.0"
 
 	defaultReplayAddress = "localhost:28020"
+
+	defaultDrainTimeout = 5 * time.Second
 )
 
 // ListenerSettings contain all the needed configuration for setting up the listener
@@ -23,9 +26,26 @@ type ListenerSettings struct {
 
 	ReplayLimit int
 
+	// "http" (default) to capture HTTP requests, or "tcp" to send captured data as is, for non-HTTP protocols
+	Protocol string
+
+	DrainTimeout time.Duration // How long to wait for pending messages on shutdown, 5s if 0
+
+	TLS     bool   // Connect to replay server using TLS
+	TLSCA   string // CA bundle to verify replay server certificate, system roots used if empty
+	TLSCert string // Client certificate, if replay server requires it
+	TLSKey  string
+
+	AuthSecret string // Shared secret used to sign messages, should match replay server one
+
+	// If set, captured messages are passed to Handler instead of replay server, and replay server settings are ignored.
+	// Used to run listener and replay server in one process. It is called from multiple goroutines.
+	Handler func(meta MessageMeta, data []byte)
+
 	Verbose bool
 }
 
+// Settings populated from command line flags when gor started in "listen" or "standalone" mode
 var Settings ListenerSettings = ListenerSettings{}
 
 // ReplayServer generates ReplayLimit and ReplayAddress settings out of the replayAddress
@@ -39,16 +59,50 @@ func (s *ListenerSettings) ReplayServer(replayAddress string) {
 	s.ReplayAddress = host_info[0]
 }
 
+// replayServerFlag applies "-r" flag value only after it parsed
+type replayServerFlag struct {
+	settings *ListenerSettings
+	value    string
+}
+
+func (f *replayServerFlag) String() string {
+	return f.value
+}
+
+func (f *replayServerFlag) Set(value string) error {
+	f.value = value
+	f.settings.ReplayServer(value)
+
+	return nil
+}
+
 func init() {
-	if len(os.Args) < 2 || os.Args[1] != "listen" {
+	if len(os.Args) < 2 || (os.Args[1] != "listen" && os.Args[1] != "standalone") {
 		return
 	}
 
 	flag.IntVar(&Settings.Port, "p", defaultPort, "Specify the http server port whose traffic you want to capture")
 	flag.StringVar(&Settings.Address, "ip", defaultAddress, "Specify IP address to listen")
 
-	replayAddress := flag.String("r", defaultReplayAddress, "Address of replay server.")
-	Settings.ReplayServer(*replayAddress)
+	flag.StringVar(&Settings.Protocol, "protocol", "http", "Captured protocol: http, or tcp to replay data as is to tcp:// forward hosts (Redis, Memcached, etc.)")
+
+	// In standalone mode other flags are defined by replay package
+	if os.Args[1] != "listen" {
+		return
+	}
+
+	replayAddress := &replayServerFlag{settings: &Settings}
+	replayAddress.Set(defaultReplayAddress)
+	flag.Var(replayAddress, "r", "Address of replay server.")
+
+	flag.DurationVar(&Settings.DrainTimeout, "drain-timeout", defaultDrainTimeout, "On shutdown wait this long for pending messages to be sent to replay server")
+
+	flag.BoolVar(&Settings.TLS, "tls", false, "Connect to replay server using TLS")
+	flag.StringVar(&Settings.TLSCA, "tls-ca", "", "CA certificates file to verify replay server, system roots used by default")
+	flag.StringVar(&Settings.TLSCert, "tls-cert", "", "Client certificate file, if replay server requires it")
+	flag.StringVar(&Settings.TLSKey, "tls-key", "", "Client certificate key file")
+
+	flag.StringVar(&Settings.AuthSecret, "auth-secret", "", "Shared secret used to sign messages, should match replay server one")
 
 	flag.BoolVar(&Settings.Verbose, "verbose", false, "Log requests")
 }
@@ -1,38 +1,54 @@
 package listener
 
 import (
+	"bytes"
+	"net"
+	"slices"
 	"sort"
+	"strconv"
 	"time"
 )
 
+// MSG_EXPIRE is idle time after which message with unknown length considered received
 const MSG_EXPIRE = 200 * time.Millisecond
 
+// MSG_BODY_EXPIRE is idle time after which HTTP request with not yet received body is sent as is
+const MSG_BODY_EXPIRE = 30 * time.Second
+
 // TCPMessage ensure that all TCP packets for given request is received, and processed in right sequence
 // Its needed because all TCP message can be fragmented or re-transmitted
 //
 // Each TCP Packet have 2 ids: acknowledgment - message_id, and sequence - packet_id
 // Message can be compiled from unique packets with same message_id which sorted by sequence
-// Message is received if we didn't receive any packets for 200ms
+// HTTP/1 message is received when its last request is complete according to Content-Length or chunked encoding.
+// Other messages are received if we didn't receive any packets for 200ms.
 type TCPMessage struct {
 	Ack     uint32 // Message ID
 	packets []*TCPPacket
 
+	buf      []byte // Data of first buffered packets, used for completeness check
+	buffered int
+
 	timer *time.Timer // Used for expire check
 
 	c_packets chan *TCPPacket
+	c_done    chan bool // Closed when message completed or expired, it does not accept packets after that
 
 	c_del_message chan *TCPMessage
+
+	verbose bool
 }
 
 // NewTCPMessage pointer created from a Acknowledgment number and a channel of messages readuy to be deleted
-func NewTCPMessage(Ack uint32, c_del chan *TCPMessage) (msg *TCPMessage) {
-	msg = &TCPMessage{Ack: Ack}
+func NewTCPMessage(Ack uint32, c_del chan *TCPMessage, verbose bool) (msg *TCPMessage) {
+	msg = &TCPMessage{Ack: Ack, verbose: verbose}
 
 	msg.c_packets = make(chan *TCPPacket)
+	msg.c_done = make(chan bool)
 	msg.c_del_message = c_del // used for notifying that message completed or expired
 
 	// Every time we receive packet we reset this timer
-	msg.timer = time.AfterFunc(MSG_EXPIRE, msg.Timeout)
+	msg.timer = time.NewTimer(MSG_EXPIRE)
 
 	go msg.listen()
 
@@ -40,39 +56,102 @@ func NewTCPMessage(Ack uint32, c_del chan *TCPMessage) (msg *TCPMessage) {
 }
 
 func (t *TCPMessage) listen() {
+	defer t.timer.Stop()
+
 	for {
 		select {
 		case packet, more := <-t.c_packets:
-			if more {
-				t.AddPacket(packet)
-			} else {
-				// Stop loop if channel closed
+			// Closed channel means that message should be sent right now
+			if !more {
+				t.Timeout()
 				return
 			}
+
+			t.AddPacket(packet)
+
+			complete, known := t.complete()
+
+			if complete {
+				t.Timeout()
+				return
+			}
+
+			// Reset message timeout timer, request with known length waits for the rest of its body longer
+			if known {
+				t.timer.Reset(MSG_BODY_EXPIRE)
+			} else {
+				t.timer.Reset(MSG_EXPIRE)
+			}
+
+		case <-t.timer.C:
+			t.Timeout()
+			return
 		}
 	}
 }
 
-// Timeout notifies message to stop listening, close channel and message ready to be sent
+// Timeout notifies message to stop listening and message ready to be sent
 func (t *TCPMessage) Timeout() {
-	close(t.c_packets)   // Notify to stop listen loop and close channel
+	close(t.c_done)      // Packets sent after this start new message
 	t.c_del_message <- t // Notify RAWListener that message is ready to be send to replay server
 }
 
 // Bytes sorts packets in right orders and return message content
 func (t *TCPMessage) Bytes() (output []byte) {
-	mk := make([]int, len(t.packets))
+	for _, packet := range t.sorted() {
+		output = append(output, packet.Data...)
+	}
+
+	return
+}
+
+// sorted returns packets in right order
+func (t *TCPMessage) sorted() []*TCPPacket {
+	packets := make([]*TCPPacket, len(t.packets))
+	copy(packets, t.packets)
+
+	// Packets can arrive out of order, sequence number defines their position. Difference used to handle wraparound.
+	sort.SliceStable(packets, func(i, j int) bool {
+		return int32(packets[i].Seq-packets[j].Seq) < 0
+	})
+
+	return packets
+}
+
+// MessageMeta describes where and when message was captured
+type MessageMeta struct {
+	ClientIP   net.IP
+	ClientPort int
+	ServerIP   net.IP
+	ServerPort int
+
+	FirstPacket time.Time
+	LastPacket  time.Time
+
+	Proto string // Set to "websocket" for WebSocket frames, "tcp" for raw data. Empty for HTTP requests, including ones decoded from HTTP/2 connection
+}
 
-	i := 0
-	for k, _ := range t.packets {
-		mk[i] = k
-		i++
+// Meta returns message metadata, collected from its packets
+func (t *TCPMessage) Meta() (meta MessageMeta) {
+	if len(t.packets) == 0 {
+		return
 	}
 
-	sort.Ints(mk)
+	first := t.packets[0]
 
-	for _, k := range mk {
-		output = append(output, t.packets[k].Data...)
+	meta.ClientIP = first.SrcIP
+	meta.ClientPort = int(first.SrcPort)
+	meta.ServerIP = first.DestIP
+	meta.ServerPort = int(first.DestPort)
+
+	for _, packet := range t.packets {
+		if meta.FirstPacket.IsZero() || packet.Captured.Before(meta.FirstPacket) {
+			meta.FirstPacket = packet.Captured
+		}
+
+		if packet.Captured.After(meta.LastPacket) {
+			meta.LastPacket = packet.Captured
+		}
 	}
 
 	return
@@ -80,22 +159,177 @@ func (t *TCPMessage) Bytes() (output []byte) {
 
 // AddPacket to the message and ensure packet uniqueness
 // TCP allows that packet can be re-send multiple times
+//
+// Packets are kept sorted by sequence, usually new packet is appended to the end.
 func (t *TCPMessage) AddPacket(packet *TCPPacket) {
-	packetFound := false
+	i := sort.Search(len(t.packets), func(i int) bool {
+		return int32(t.packets[i].Seq-packet.Seq) >= 0
+	})
+
+	if i < len(t.packets) && t.packets[i].Seq == packet.Seq {
+		debug(t.verbose, "Received packet with same sequence")
+		return
+	}
+
+	t.packets = slices.Insert(t.packets, i, packet)
+
+	// Packet arrived out of order, buffered data is not valid anymore
+	if i < t.buffered {
+		t.buf = t.buf[:0]
+		t.buffered = 0
+	}
+}
+
+// complete checks that message has all its packets and consists of complete HTTP/1 requests.
+// Known is false if message is not HTTP/1, such message is complete only when client stops sending.
+func (t *TCPMessage) complete() (complete bool, known bool) {
+	if len(t.packets) == 0 || !isHTTP1(t.packets[0].Data) {
+		return false, false
+	}
 
-	for _, pkt := range t.packets {
-		if packet.Seq == pkt.Seq {
-			packetFound = true
+	for i := 1; i < len(t.packets); i++ {
+		prev := t.packets[i-1]
+
+		// Some packet still missing
+		if prev.Seq+uint32(len(prev.Data)) != t.packets[i].Seq {
+			return false, true
+		}
+	}
+
+	for ; t.buffered < len(t.packets); t.buffered++ {
+		t.buf = append(t.buf, t.packets[t.buffered].Data...)
+	}
+
+	return httpComplete(t.buf)
+}
+
+// httpComplete returns true if data consists of complete HTTP/1 requests, pipelined requests allowed.
+// Known is false if data can't be parsed as HTTP/1 requests.
+func httpComplete(data []byte) (complete bool, known bool) {
+	for len(data) > 0 {
+		end, known := httpRequestEnd(data)
+
+		if !known {
+			return false, false
+		}
+
+		if end == -1 {
+			return false, true
+		}
+
+		data = data[end:]
+	}
+
+	return true, true
+}
+
+// httpRequestEnd returns length of first HTTP/1 request in data, or -1 if request is not complete yet.
+// Body length is taken from Transfer-Encoding: chunked (including trailers) or Content-Length, request without them has no body.
+func httpRequestEnd(data []byte) (end int, known bool) {
+	line, rest, found := cutLine(data)
+
+	if !found {
+		return -1, isHTTP1(data)
+	}
+
+	if !isHTTP1(line) {
+		return 0, false
+	}
+
+	chunked := false
+	length := 0
+
+	for {
+		if line, rest, found = cutLine(rest); !found {
+			return -1, true
+		}
+
+		if len(line) == 0 {
+			break
+		}
+
+		name, value, _ := bytes.Cut(line, []byte(":"))
+		name = bytes.TrimSpace(name)
+		value = bytes.TrimSpace(value)
+
+		switch {
+		case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+			// Chunked is always the last coding
+			chunked = len(value) >= 7 && bytes.EqualFold(value[len(value)-7:], []byte("chunked"))
+		case bytes.EqualFold(name, []byte("Content-Length")):
+			n, err := strconv.Atoi(string(value))
+
+			if err != nil || n < 0 {
+				return 0, false
+			}
+
+			length = n
+		}
+	}
+
+	if chunked {
+		return chunkedEnd(data, rest)
+	}
+
+	if len(rest) < length {
+		return -1, true
+	}
+
+	return len(data) - len(rest) + length, true
+}
+
+// chunkedEnd returns length of request with chunked body, which starts at body, or -1 if last chunk and trailers not received yet
+func chunkedEnd(data []byte, body []byte) (end int, known bool) {
+	for {
+		line, rest, found := cutLine(body)
+
+		if !found {
+			return -1, true
+		}
+
+		// Chunk extensions are ignored
+		size, _, _ := bytes.Cut(line, []byte(";"))
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+
+		if err != nil || n < 0 {
+			return 0, false
+		}
+
+		if n == 0 {
+			body = rest
 			break
 		}
+
+		if int64(len(rest)) < n+2 {
+			return -1, true
+		}
+
+		if !bytes.HasPrefix(rest[n:], []byte("\r\n")) {
+			return 0, false
+		}
+
+		body = rest[n+2:]
 	}
 
-	if packetFound {
-		Debug("Received packet with same sequence")
-	} else {
-		t.packets = append(t.packets, packet)
+	// Trailers end with empty line
+	for {
+		line, rest, found := cutLine(body)
+
+		if !found {
+			return -1, true
+		}
+
+		body = rest
+
+		if len(line) == 0 {
+			return len(data) - len(body), true
+		}
 	}
+}
+
+// cutLine returns first line of data without line ending, and data after it
+func cutLine(data []byte) (line []byte, rest []byte, found bool) {
+	line, rest, found = bytes.Cut(data, []byte("\n"))
 
-	// Reset message timeout timer
-	t.timer.Reset(MSG_EXPIRE)
+	return bytes.TrimSuffix(line, []byte("\r")), rest, found
 }
@@ -2,8 +2,10 @@ package listener
 
 import (
 	"encoding/binary"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // TCP Flags
@@ -33,6 +35,11 @@ type TCPPacket struct {
 	Checksum   uint16
 	Urgent     uint16
 
+	// Taken from IP layer and socket, not part of TCP header
+	SrcIP    net.IP
+	DestIP   net.IP
+	Captured time.Time
+
 	Data []byte
 }
 
@@ -45,17 +52,17 @@ func ParseTCPPacket(b []byte) (p *TCPPacket) {
 
 // Parse TCP Packet, inspired by: https://github.com/miekg/pcap/blob/master/packet.go
 func (t *TCPPacket) Parse() {
-	t.ParseBasic()
-	t.SrcPort = binary.BigEndian.Uint16(t.Data[0:2])
-	t.DestPort = binary.BigEndian.Uint16(t.Data[2:4])
 	t.Flags = binary.BigEndian.Uint16(t.Data[12:14]) & 0x1FF
 	t.Window = binary.BigEndian.Uint16(t.Data[14:16])
 	t.Checksum = binary.BigEndian.Uint16(t.Data[16:18])
 	t.Urgent = binary.BigEndian.Uint16(t.Data[18:20])
+	t.ParseBasic()
 }
 
-// ParseBasic set of fields
+// ParseBasic set of fields, after it Data contains only packet payload
 func (t *TCPPacket) ParseBasic() {
+	t.SrcPort = binary.BigEndian.Uint16(t.Data[0:2])
+	t.DestPort = binary.BigEndian.Uint16(t.Data[2:4])
 	t.Seq = binary.BigEndian.Uint32(t.Data[4:8])
 	t.Ack = binary.BigEndian.Uint32(t.Data[8:12])
 	t.DataOffset = (t.Data[12] & 0xF0) >> 4
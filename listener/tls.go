@@ -0,0 +1,42 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// tlsConfig builds TLS configuration for connection to replay server
+//
+// Replay server certificate verified using TLSCA, or system roots if it empty.
+// If replay server requires client certificates, TLSCert and TLSKey should be set.
+func (s *ListenerSettings) tlsConfig() (config *tls.Config, err error) {
+	config = &tls.Config{}
+
+	if s.TLSCA != "" {
+		pem, err := os.ReadFile(s.TLSCA)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + s.TLSCA)
+		}
+	}
+
+	if s.TLSCert != "" || s.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(s.TLSCert, s.TLSKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return
+}
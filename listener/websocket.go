@@ -0,0 +1,113 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// WebSocket capture
+//
+// After client requested "Upgrade: websocket", next data of the connection are WebSocket frames,
+// not HTTP requests. Listener splits them into frames, and sends each frame as separate message
+// with "proto=websocket" meta and time frame was captured, so replay server can replay the session
+// with original timing. Client frames are masked, so they can be sent to host as is.
+
+const (
+	wsOpcodeClose = 0x8
+)
+
+var errWebSocketFrame = errors.New("malformed WebSocket frame")
+
+// Frames bigger than this are not expected from clients, connection state is dropped
+const maxWebSocketFrame = 16 << 20
+
+// wsConn holds state of one client connection
+type wsConn struct {
+	buf []byte // Bytes of incomplete frame
+
+	used time.Time
+}
+
+// isWebSocketUpgrade returns true if HTTP/1.x request asks to upgrade connection to WebSocket
+func isWebSocketUpgrade(data []byte) bool {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+
+	if end == -1 {
+		end = len(data)
+	}
+
+	headers := bytes.ToLower(data[:end])
+
+	return bytes.Contains(headers, []byte("\nupgrade: websocket")) || bytes.Contains(headers, []byte("\nupgrade:websocket"))
+}
+
+// write processes captured client bytes and returns complete frames, closed is true after close frame
+func (c *wsConn) write(data []byte) (frames [][]byte, closed bool, err error) {
+	c.used = time.Now()
+	c.buf = append(c.buf, data...)
+
+	for {
+		size, err := wsFrameSize(c.buf)
+
+		if err != nil {
+			return frames, false, err
+		}
+
+		if size == 0 || len(c.buf) < size {
+			return frames, false, nil
+		}
+
+		frame := append([]byte(nil), c.buf[:size]...)
+		frames = append(frames, frame)
+		c.buf = c.buf[size:]
+
+		if frame[0]&0x0F == wsOpcodeClose {
+			return frames, true, nil
+		}
+	}
+}
+
+// wsFrameSize returns size of frame at the beginning of buf, or 0 if its header is incomplete
+// https://tools.ietf.org/html/rfc6455#section-5.2
+func wsFrameSize(buf []byte) (int, error) {
+	if len(buf) < 2 {
+		return 0, nil
+	}
+
+	header := 2
+	length := uint64(buf[1] & 0x7F)
+
+	switch length {
+	case 126:
+		header += 2
+
+		if len(buf) < header {
+			return 0, nil
+		}
+
+		length = uint64(binary.BigEndian.Uint16(buf[2:4]))
+	case 127:
+		header += 8
+
+		if len(buf) < header {
+			return 0, nil
+		}
+
+		length = binary.BigEndian.Uint64(buf[2:10])
+	}
+
+	// Client frames are always masked
+	if buf[1]&0x80 == 0 {
+		return 0, errWebSocketFrame
+	}
+
+	header += 4
+
+	if length > maxWebSocketFrame {
+		return 0, errWebSocketFrame
+	}
+
+	return header + int(length), nil
+}
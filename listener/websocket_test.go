@@ -0,0 +1,123 @@
+package listener
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// wsFrame returns masked client frame
+func wsFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) < 1<<16:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	return frame
+}
+
+func TestWebSocketConn(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 300)
+	data := append(append(wsFrame(0x1, []byte("hello")), wsFrame(0x2, long)...), wsFrame(0x8, nil)...)
+
+	// Frames can be split between packets at any position
+	for i := 0; i < len(data); i++ {
+		conn := &wsConn{}
+
+		frames, closed, err := conn.write(data[:i])
+
+		if err != nil || closed {
+			t.Fatal(i, err, closed)
+		}
+
+		rest, closed, err := conn.write(data[i:])
+		frames = append(frames, rest...)
+
+		if err != nil || !closed || len(frames) != 3 || len(frames[1]) != 4+4+300 || !bytes.Equal(frames[0], wsFrame(0x1, []byte("hello"))) {
+			t.Fatal("Wrong frames", i, err, closed, len(frames))
+		}
+	}
+
+	if _, _, err := (&wsConn{}).write([]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'}); err != errWebSocketFrame {
+		t.Error("Unmasked client frame should be rejected", err)
+	}
+}
+
+func TestListenerWebSocket(t *testing.T) {
+	l := &Listener{http2: make(map[string]*http2Conn), websockets: make(map[string]*wsConn)}
+	start := time.Now()
+
+	message := func(packets ...[]byte) *TCPMessage {
+		m := &TCPMessage{}
+
+		for i, data := range packets {
+			m.packets = append(m.packets, &TCPPacket{Data: data, SrcIP: net.IPv4(10, 0, 0, 1), SrcPort: 51234, Seq: uint32(i * 1000), Captured: start.Add(time.Duration(i) * time.Second)})
+		}
+
+		return m
+	}
+
+	payloads := l.payloads(message([]byte("GET /chat HTTP/1.1\r\nHost: svc\r\nConnection: Upgrade\r\nUpgrade: WebSocket\r\n\r\n")))
+
+	if len(payloads) != 1 || payloads[0].meta.Proto != "" || len(l.websockets) != 1 {
+		t.Fatal("Upgrade request should be sent as is", payloads)
+	}
+
+	hello := wsFrame(0x1, []byte("hello"))
+	payloads = l.payloads(message(hello[:3], hello[3:], wsFrame(0x1, []byte("world"))))
+
+	if len(payloads) != 2 || payloads[0].meta.Proto != "websocket" || !bytes.Equal(payloads[0].data, hello) {
+		t.Fatal("Frames should be sent one by one", payloads)
+	}
+
+	if !payloads[0].meta.LastPacket.Equal(start.Add(time.Second)) || !payloads[1].meta.LastPacket.Equal(start.Add(2*time.Second)) {
+		t.Error("Frame time should be capture time of its last packet", payloads[0].meta, payloads[1].meta)
+	}
+
+	if payloads = l.payloads(message(wsFrame(0x8, nil))); len(payloads) != 1 || len(l.websockets) != 0 {
+		t.Error("Connection should be forgotten after close frame", payloads, len(l.websockets))
+	}
+
+	// Upgrade refused, next request of the same connection is HTTP
+	l.payloads(message([]byte("GET /chat HTTP/1.1\r\nHost: svc\r\nUpgrade: websocket\r\n\r\n")))
+
+	if payloads := l.payloads(message([]byte("GET / HTTP/1.1\r\nHost: svc\r\n\r\n"))); len(payloads) != 1 || payloads[0].meta.Proto != "" || len(l.websockets) != 0 {
+		t.Error("HTTP request should reset WebSocket connection", payloads)
+	}
+}
+
+func TestListenerWebSocketLimit(t *testing.T) {
+	l := &Listener{settings: ListenerSettings{ReplayLimit: 1}, http2: make(map[string]*http2Conn), websockets: make(map[string]*wsConn)}
+
+	message := func(data []byte) *TCPMessage {
+		return &TCPMessage{packets: []*TCPPacket{{Data: data, SrcIP: net.IPv4(10, 0, 0, 1), SrcPort: 51234}}}
+	}
+
+	if payloads := l.limit(l.payloads(message([]byte("GET /chat HTTP/1.1\r\nHost: svc\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")))); len(payloads) != 1 {
+		t.Fatal("Upgrade request should be sent", payloads)
+	}
+
+	for i := 0; i < 3; i++ {
+		if payloads := l.limit(l.payloads(message(wsFrame(0x1, []byte("hello"))))); len(payloads) != 1 {
+			t.Error("Frames should not be limited", i, payloads)
+		}
+	}
+
+	l.payloads(message(wsFrame(0x8, nil)))
+
+	if payloads := l.limit(l.payloads(message([]byte("GET / HTTP/1.1\r\nHost: svc\r\n\r\n")))); len(payloads) != 0 {
+		t.Error("Requests above limit should be dropped", payloads)
+	}
+}
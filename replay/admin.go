@@ -0,0 +1,298 @@
+package replay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Admin HTTP API allows to manage forward hosts of running replay server:
+//
+//     GET    /hosts                            List hosts with current and total stats
+//     POST   /hosts?url=http://dev&limit=10    Add host
+//     DELETE /hosts?url=http://dev             Remove host, in-flight requests are still waited
+//     POST   /hosts/pause?url=http://dev       Stop forwarding to host
+//     POST   /hosts/resume?url=http://dev      Continue forwarding to host
+//     POST   /hosts/limit?url=http://dev&limit=20
+//     GET    /errors                           Recent request errors
+//
+// Enabled with "-admin" flag:
+//
+//     gor replay -f http://staging.server -admin localhost:28021
+//
+// With "-admin-token" requests should have "Authorization: Bearer <token>" header. Token is required
+// if admin API listens not only on loopback address.
+//
+// Hosts added via API get only url and limit, TLS, redirect, header, HTTP/2 and command options are not set.
+type adminHandler struct {
+	factory *RequestFactory
+	verbose bool
+}
+
+// ErrAdminToken returned by NewServer if admin API is exposed to network without token
+var ErrAdminToken = errors.New("admin API on non-loopback address requires admin token")
+
+// isLoopback returns true if address accepts connections only from local host
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// HostInfo is a host representation returned by admin API
+type HostInfo struct {
+	Url    string `json:"url"`
+	Limit  int    `json:"limit"`
+	Paused bool   `json:"paused"`
+
+	// Stats for current second
+	Count     int         `json:"count"`
+	Errors    int         `json:"errors"`
+	Redirects int         `json:"redirects"`
+	Codes     map[int]int `json:"codes"`
+
+	Commands map[string]int `json:"commands,omitempty"`
+
+	Pending int `json:"pending"`
+
+	Total HostSummary `json:"total"`
+}
+
+// AdminHandler returns http.Handler serving admin API
+func (s *Server) AdminHandler() http.Handler {
+	h := &adminHandler{factory: s.factory, verbose: s.settings.Verbose}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hosts", h.hosts)
+	mux.HandleFunc("/hosts/pause", h.pause)
+	mux.HandleFunc("/hosts/resume", h.resume)
+	mux.HandleFunc("/hosts/limit", h.limit)
+	mux.HandleFunc("/errors", h.errors)
+
+	if s.settings.AdminToken == "" {
+		return mux
+	}
+
+	authorization := []byte("Bearer " + s.settings.AdminToken)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), authorization) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (h *adminHandler) hosts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		h.list(w)
+	case "POST":
+		h.add(w, r)
+	case "DELETE":
+		h.remove(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *adminHandler) list(w http.ResponseWriter) {
+	var info []*HostInfo
+
+	h.factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		for _, host := range hosts {
+			info = append(info, h.hostInfo(host))
+		}
+
+		return hosts
+	})
+
+	writeJSON(w, info)
+}
+
+func (h *adminHandler) hostInfo(host *ForwardHost) *HostInfo {
+	host.Stat.Touch()
+
+	info := &HostInfo{
+		Url:       host.Url,
+		Limit:     host.Limit,
+		Paused:    host.Paused,
+		Count:     host.Stat.Count,
+		Errors:    host.Stat.Errors,
+		Redirects: host.Stat.Redirects,
+		Codes:     make(map[int]int),
+		Pending:   host.Stat.Pending,
+		Total:     h.factory.summary.HostTotals(host),
+	}
+
+	for code, count := range host.Stat.Codes {
+		info.Codes[code] = count
+	}
+
+	if len(host.Stat.Commands) > 0 {
+		info.Commands = make(map[string]int)
+
+		for name, count := range host.Stat.Commands {
+			info.Commands[name] = count
+		}
+	}
+
+	return info
+}
+
+func (h *adminHandler) add(w http.ResponseWriter, r *http.Request) {
+	address := r.FormValue("url")
+
+	if address == "" {
+		http.Error(w, "url parameter required", http.StatusBadRequest)
+		return
+	}
+
+	// Unlike -f flag, only single host without limit suffix is accepted, limit has its own parameter
+	if strings.ContainsAny(address, ",|") {
+		http.Error(w, "url should be single host, without \",\" and \"|\"", http.StatusBadRequest)
+		return
+	}
+
+	settings := ReplaySettings{Hosts: []*ForwardHost{{Url: address}}, Verbose: h.verbose}
+	newHosts, err := settings.ForwardedHosts()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newHost := newHosts[0]
+
+	if limit := r.FormValue("limit"); limit != "" {
+		if newHost.Limit, err = strconv.Atoi(limit); err != nil || newHost.Limit < 0 {
+			http.Error(w, "limit should be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var info *HostInfo
+
+	h.factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		for _, host := range hosts {
+			if host.Url == newHost.Url {
+				return hosts
+			}
+		}
+
+		info = h.hostInfo(newHost)
+
+		return h.factory.swapHosts(hosts, append(hosts[:len(hosts):len(hosts)], newHost))
+	})
+
+	if info == nil {
+		http.Error(w, "Host already exists", http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, info)
+}
+
+func (h *adminHandler) remove(w http.ResponseWriter, r *http.Request) {
+	url := r.FormValue("url")
+	found := false
+
+	h.factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		newHosts := make([]*ForwardHost, 0, len(hosts))
+
+		for _, host := range hosts {
+			if host.Url == url {
+				found = true
+			} else {
+				newHosts = append(newHosts, host)
+			}
+		}
+
+		return h.factory.swapHosts(hosts, newHosts)
+	})
+
+	if !found {
+		http.Error(w, "Host not found", http.StatusNotFound)
+	}
+}
+
+// update applies change to host with given url and returns its info
+func (h *adminHandler) update(w http.ResponseWriter, r *http.Request, change func(host *ForwardHost)) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	url := r.FormValue("url")
+
+	var info *HostInfo
+
+	h.factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		for _, host := range hosts {
+			if host.Url == url {
+				change(host)
+				info = h.hostInfo(host)
+			}
+		}
+
+		return hosts
+	})
+
+	if info == nil {
+		http.Error(w, "Host not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, info)
+}
+
+func (h *adminHandler) pause(w http.ResponseWriter, r *http.Request) {
+	h.update(w, r, func(host *ForwardHost) { host.Paused = true })
+}
+
+func (h *adminHandler) resume(w http.ResponseWriter, r *http.Request) {
+	h.update(w, r, func(host *ForwardHost) { host.Paused = false })
+}
+
+func (h *adminHandler) limit(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+
+	if err != nil || limit < 0 {
+		http.Error(w, "limit should be a non-negative number", http.StatusBadRequest)
+		return
+	}
+
+	h.update(w, r, func(host *ForwardHost) { host.Limit = limit })
+}
+
+func (h *adminHandler) errors(w http.ResponseWriter, r *http.Request) {
+	var errors []*RequestError
+
+	h.factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		errors = append(errors, h.factory.errors...)
+		return hosts
+	})
+
+	writeJSON(w, errors)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,147 @@
+package replay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func adminRequest(t *testing.T, admin *httptest.Server, method string, path string, params url.Values, v interface{}) int {
+	req, _ := http.NewRequest(method, admin.URL+path+"?"+params.Encode(), nil)
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode == http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	forward := mockForwardServer(received)
+	defer forward.Close()
+
+	settings := ReplaySettings{ForwardAddress: forward.URL}
+	forwardHosts, _ := settings.ForwardedHosts()
+	server := &Server{settings: settings, factory: NewRequestFactory(forwardHosts, false)}
+	defer server.factory.Close()
+
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	host := url.Values{"url": {forward.URL}}
+
+	var info HostInfo
+	adminRequest(t, admin, "POST", "/hosts/pause", host, &info)
+
+	if !info.Paused {
+		t.Error("Host should be paused")
+	}
+
+	server.factory.Add(getRequest())
+	server.factory.inFlight.Wait()
+
+	var hosts []*HostInfo
+	adminRequest(t, admin, "GET", "/hosts", nil, &hosts)
+
+	if len(hosts) != 1 || hosts[0].Total.Dropped != 1 || hosts[0].Total.Forwarded != 0 {
+		t.Error("Requests to paused host should be dropped", hosts)
+	}
+
+	adminRequest(t, admin, "POST", "/hosts/resume", host, nil)
+	adminRequest(t, admin, "POST", "/hosts/limit", url.Values{"url": {forward.URL}, "limit": {"7"}}, &info)
+
+	if info.Paused || info.Limit != 7 {
+		t.Error("Host should be resumed with new limit", info)
+	}
+
+	// Nothing listens on this address, so requests will fail
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	if code := adminRequest(t, admin, "POST", "/hosts", url.Values{"url": {closed.URL}}, nil); code != http.StatusOK {
+		t.Error("Host should be added", code)
+	}
+
+	if code := adminRequest(t, admin, "DELETE", "/hosts", host, nil); code != http.StatusOK {
+		t.Error("Host should be removed", code)
+	}
+
+	server.factory.Add(getRequest())
+	server.factory.inFlight.Wait()
+
+	adminRequest(t, admin, "GET", "/hosts", nil, &hosts)
+
+	if len(hosts) != 1 || hosts[0].Url != closed.URL {
+		t.Error("Only added host should remain", hosts)
+	}
+
+	var errors []*RequestError
+	adminRequest(t, admin, "GET", "/errors", nil, &errors)
+
+	if len(errors) != 1 || errors[0].Host != closed.URL {
+		t.Error("Recent errors should be returned", errors)
+	}
+
+	if code := adminRequest(t, admin, "POST", "/hosts/pause", url.Values{"url": {"http://unknown"}}, nil); code != http.StatusNotFound {
+		t.Error("Unknown host should not be found", code)
+	}
+	if code := adminRequest(t, admin, "POST", "/hosts", url.Values{"url": {"http://dev.server"}, "limit": {"abc"}}, nil); code != http.StatusBadRequest {
+		t.Error("Host with invalid limit should not be added", code)
+	}
+
+	for _, address := range []string{"http://dev.server,http://qa.server", "http://dev.server|5"} {
+		if code := adminRequest(t, admin, "POST", "/hosts", url.Values{"url": {address}}, nil); code != http.StatusBadRequest {
+			t.Error("Only single host should be accepted", address, code)
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	server := &Server{settings: ReplaySettings{AdminToken: "secret"}, factory: NewRequestFactory(nil, false)}
+	defer server.factory.Close()
+
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	if code := adminRequest(t, admin, "GET", "/hosts", nil, nil); code != http.StatusUnauthorized {
+		t.Error("Request without token should be rejected", code)
+	}
+
+	req, _ := http.NewRequest("GET", admin.URL+"/hosts", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Request with token should be accepted", resp.StatusCode)
+	}
+}
+
+func TestAdminLoopback(t *testing.T) {
+	if _, err := NewStandalone(ReplaySettings{AdminAddress: ":28021"}); err != ErrAdminToken {
+		t.Error("Admin API on all interfaces should require token", err)
+	}
+
+	if _, err := NewStandalone(ReplaySettings{AdminAddress: "0.0.0.0:28021"}); err != ErrAdminToken {
+		t.Error("Admin API on all interfaces should require token", err)
+	}
+
+	for _, address := range []string{"localhost:28021", "127.0.0.1:28021", "[::1]:28021"} {
+		if !isLoopback(address) {
+			t.Error("Should be loopback", address)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package replay
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Affinity defines how requests are grouped by client, requests of each client are sent to host one by one in capture order:
+//
+//	ip              client IP captured by listener
+//	cookie:<name>   value of given cookie, e.g. cookie:session_id
+//	header:<name>   value of given header, e.g. header:Authorization
+//
+// Requests of different clients are still sent in parallel. Empty Affinity disables ordering.
+type Affinity string
+
+var errAffinity = errors.New("affinity should be \"ip\", \"cookie:<name>\" or \"header:<name>\"")
+
+// Validate returns error if affinity has unknown format
+func (a Affinity) Validate() error {
+	source, name, _ := strings.Cut(string(a), ":")
+
+	switch {
+	case a == "", a == "ip":
+		return nil
+	case (source == "cookie" || source == "header") && name != "":
+		return nil
+	}
+
+	return errAffinity
+}
+
+// clientKey returns key of client request belongs to, empty if request can't be grouped
+func (a Affinity) clientKey(request *http.Request) string {
+	source, name, _ := strings.Cut(string(a), ":")
+
+	switch source {
+	case "ip":
+		return Meta(request).ClientIP
+	case "cookie":
+		if cookie, err := request.Cookie(name); err == nil {
+			return cookie.Value
+		}
+	case "header":
+		return request.Header.Get(name)
+	}
+
+	return ""
+}
+
+// session is a queue of requests from one client to one host, owned by handleRequests()
+type session struct {
+	key  string
+	host *ForwardHost
+
+	queue []*queuedRequest // Sorted by capture time
+
+	busy      bool // Request sent and waiting for response
+	scheduled bool // Waiting for reorder window before sending first request
+}
+
+type queuedRequest struct {
+	request  *http.Request
+	captured time.Time
+}
+
+type sessionKey struct {
+	host   *ForwardHost
+	client string
+}
+
+// enqueue adds request to client session of given host
+//
+// Listeners send requests in parallel, so they can arrive slightly out of order. Session waits
+// for reorder window before sending its first request, and requests are sorted by capture time.
+func (f *RequestFactory) enqueue(host *ForwardHost, client string, request *http.Request) {
+	key := sessionKey{host, client}
+	s, ok := f.sessions[key]
+
+	if !ok {
+		s = &session{key: client, host: host}
+		f.sessions[key] = s
+	}
+
+	captured := Meta(request).FirstPacket
+
+	if captured.IsZero() {
+		captured = time.Now()
+	}
+
+	i := sort.Search(len(s.queue), func(i int) bool { return s.queue[i].captured.After(captured) })
+	s.queue = append(s.queue, nil)
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = &queuedRequest{request, captured}
+
+	if !s.busy && !s.scheduled {
+		s.scheduled = true
+
+		time.AfterFunc(f.affinityWindow, func() {
+			select {
+			case f.c_dispatch <- s:
+			case <-f.c_close:
+			}
+		})
+	}
+}
+
+// next sends next request of session, or forgets session if there is nothing to send
+func (f *RequestFactory) next(s *session) {
+	if len(s.queue) == 0 {
+		s.busy = false
+		delete(f.sessions, sessionKey{s.host, s.key})
+		return
+	}
+
+	queued := s.queue[0]
+	s.queue = s.queue[1:]
+	s.busy = true
+
+	f.send(s.host, queued.request, s)
+}
+
+// SetAffinity enables ordering of requests by client, see Affinity. Requests already queued are not affected.
+func (f *RequestFactory) SetAffinity(affinity Affinity, window time.Duration) {
+	f.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		f.affinity = affinity
+		f.affinityWindow = window
+		return hosts
+	})
+}
@@ -0,0 +1,75 @@
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAffinityValidate(t *testing.T) {
+	for _, a := range []Affinity{"", "ip", "cookie:session_id", "header:Authorization"} {
+		if err := a.Validate(); err != nil {
+			t.Error(a, "should be valid", err)
+		}
+	}
+
+	for _, a := range []Affinity{"session", "cookie:", "header"} {
+		if err := a.Validate(); err == nil {
+			t.Error(a, "should be invalid")
+		}
+	}
+}
+
+func TestAffinityOrder(t *testing.T) {
+	var mu sync.Mutex
+
+	received := make(map[string][]string)
+	active := make(map[string]int)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := r.Header.Get("X-Client")
+
+		mu.Lock()
+		active[client]++
+		if active[client] > 1 {
+			t.Error("Requests of one client should not be sent in parallel", client)
+		}
+		received[client] = append(received[client], r.URL.Path)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		active[client]--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	settings := ReplaySettings{ForwardAddress: server.URL}
+	hosts, _ := settings.ForwardedHosts()
+	factory := NewRequestFactory(hosts, false)
+	factory.SetAffinity("header:X-Client", 50*time.Millisecond)
+	defer factory.Close()
+
+	captured := time.Now()
+
+	// Requests arrive in reverse capture order
+	for i := 4; i >= 0; i-- {
+		for _, client := range []string{"a", "b"} {
+			request, _ := ParseRequest([]byte("GET /" + strconv.Itoa(i) + " HTTP/1.1\r\nHost: www.w3.org\r\nX-Client: " + client + "\r\n\r\n"))
+			factory.Add(withMeta(request, MessageMeta{FirstPacket: captured.Add(time.Duration(i) * time.Millisecond)}))
+		}
+	}
+
+	factory.inFlight.Wait()
+
+	for _, client := range []string{"a", "b"} {
+		if got := strings.Join(received[client], " "); got != "/0 /1 /2 /3 /4" {
+			t.Error("Requests should be sent in capture order", client, got)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package replay
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Messages signed more than maxAuthAge ago (or in future, because of clock skew) are rejected
+const maxAuthAge = 5 * time.Minute
+
+var (
+	errAuthMissing   = errors.New("authentication line missing")
+	errAuthMalformed = errors.New("malformed authentication line")
+	errAuthExpired   = errors.New("authentication timestamp expired")
+	errAuthSignature = errors.New("wrong signature")
+	errAuthReplayed  = errors.New("message already received")
+)
+
+// authNonces remembers nonces of authenticated messages, so captured message can't be sent again
+//
+// Nonce is kept while its timestamp is not expired, older messages are rejected by timestamp anyway.
+type authNonces struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newAuthNonces() *authNonces {
+	return &authNonces{seen: make(map[string]time.Time), lastPrune: time.Now()}
+}
+
+// use returns false if nonce was already used
+func (n *authNonces) use(nonce string, timestamp time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if now := time.Now(); now.Sub(n.lastPrune) > time.Minute {
+		for key, t := range n.seen {
+			if now.Sub(t) > maxAuthAge {
+				delete(n.seen, key)
+			}
+		}
+
+		n.lastPrune = now
+	}
+
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+
+	n.seen[nonce] = timestamp
+
+	return true
+}
+
+// authLine is parsed authentication line added by listener:
+//
+//     GOR-AUTH <unix timestamp> <hex nonce> <hex HMAC-SHA256 of timestamp, "\n", nonce, "\n" and message>\n
+type authLine struct {
+	timestamp string
+	signedAt  time.Time
+	nonce     string
+	signature []byte
+}
+
+// Authentication line is much shorter, longer lines are rejected without reading them to the end
+const maxAuthLine = 256
+
+// readAuthLine reads authentication line, so connections without valid one are rejected before message is read
+func readAuthLine(reader *bufio.Reader) (*authLine, error) {
+	if prefix, _ := reader.Peek(len("GOR-AUTH ")); string(prefix) != "GOR-AUTH " {
+		return nil, errAuthMissing
+	}
+
+	line, err := reader.ReadSlice('\n')
+
+	if err != nil || len(line) > maxAuthLine {
+		return nil, errAuthMalformed
+	}
+
+	fields := strings.Fields(string(line))
+
+	if len(fields) != 4 {
+		return nil, errAuthMalformed
+	}
+
+	timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+
+	if err != nil {
+		return nil, errAuthMalformed
+	}
+
+	auth := &authLine{timestamp: fields[1], signedAt: time.Unix(timestamp, 0), nonce: fields[2]}
+
+	if age := time.Since(auth.signedAt); age > maxAuthAge || age < -maxAuthAge {
+		return nil, errAuthExpired
+	}
+
+	if _, err = hex.DecodeString(auth.nonce); err != nil || auth.nonce == "" {
+		return nil, errAuthMalformed
+	}
+
+	if auth.signature, err = hex.DecodeString(fields[3]); err != nil {
+		return nil, errAuthMalformed
+	}
+
+	return auth, nil
+}
+
+// verifyAuth checks signature of message, messages with nonce already seen in nonces are rejected
+func (r *ReplaySettings) verifyAuth(auth *authLine, message []byte, nonces *authNonces) error {
+	mac := hmac.New(sha256.New, []byte(r.AuthSecret))
+	mac.Write([]byte(auth.timestamp + "\n" + auth.nonce + "\n"))
+	mac.Write(message)
+
+	if !hmac.Equal(auth.signature, mac.Sum(nil)) {
+		return errAuthSignature
+	}
+
+	if !nonces.use(auth.nonce, auth.signedAt) {
+		return errAuthReplayed
+	}
+
+	return nil
+}
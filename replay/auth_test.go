@@ -0,0 +1,77 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedMessage(secret string, signedAt time.Time, nonce string, message string) []byte {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + message))
+
+	return []byte("GOR-AUTH " + timestamp + " " + nonce + " " + hex.EncodeToString(mac.Sum(nil)) + "\n" + message)
+}
+
+func authenticate(settings *ReplaySettings, data []byte, nonces *authNonces) ([]byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	auth, err := readAuthLine(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	message, _ := io.ReadAll(reader)
+
+	return message, settings.verifyAuth(auth, message, nonces)
+}
+
+func TestAuthenticate(t *testing.T) {
+	settings := ReplaySettings{AuthSecret: "secret"}
+	nonces := newAuthNonces()
+	message := "GET / HTTP/1.1\r\n\r\n"
+	now := time.Now()
+
+	tests := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte(message), errAuthMissing},
+		{[]byte("GOR-AUTH 123"), errAuthMalformed},
+		{[]byte("GOR-AUTH 123 abcd\n" + message), errAuthMalformed},
+		{[]byte("GOR-AUTH now abcd abcd\n" + message), errAuthMalformed},
+		{signedMessage("secret", now, "not-hex", message), errAuthMalformed},
+		{signedMessage("secret", now.Add(-maxAuthAge-time.Minute), "01", message), errAuthExpired},
+		{signedMessage("secret", now.Add(maxAuthAge+time.Minute), "02", message), errAuthExpired},
+		{signedMessage("wrong", now, "03", message), errAuthSignature},
+		{signedMessage("secret", now, "04", message), nil},
+		{signedMessage("secret", now, "04", message), errAuthReplayed},
+		{signedMessage("secret", now, "05", message), nil},
+	}
+
+	for i, tt := range tests {
+		data, err := authenticate(&settings, tt.data, nonces)
+
+		if err != tt.err {
+			t.Errorf("Case %d: expected error %v, got %v", i, tt.err, err)
+			continue
+		}
+
+		if err == nil && string(data) != message {
+			t.Errorf("Case %d: authentication line should be removed: %q", i, data)
+		}
+	}
+
+	if _, err := readAuthLine(bufio.NewReader(bytes.NewReader([]byte("GOR-AUTH " + strings.Repeat("1", maxAuthLine) + "\n" + message)))); err != errAuthMalformed {
+		t.Error("Too long authentication line should be rejected", err)
+	}
+}
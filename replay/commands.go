@@ -0,0 +1,261 @@
+package replay
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command replay
+//
+// Data of raw TCP streams forwarded to redis:// and memcached:// hosts is parsed into commands.
+// Commands can be dropped or have their keys rewritten, and replies of host are matched to
+// commands to collect per-command latency and errors. Commands are sent with original timing, see stream.go.
+
+// CommandOptions control commands replayed to redis:// and memcached:// hosts
+type CommandOptions struct {
+	// Commands which are not replayed, case insensitive. "@write" drops all commands modifying data.
+	Drop []string
+
+	// Replaces key prefix, "from=to": "prod:=staging:" turns "prod:user:1" into "staging:user:1".
+	// Empty "from" adds prefix to all keys.
+	RewriteKeys string
+}
+
+var errRewriteKeys = errors.New("rewrite keys should be in \"from=to\" format")
+
+// Validate returns error if options have invalid format
+func (o CommandOptions) Validate() error {
+	if o.RewriteKeys != "" && !strings.Contains(o.RewriteKeys, "=") {
+		return errRewriteKeys
+	}
+
+	return nil
+}
+
+// drops returns true if command should not be replayed
+func (o CommandOptions) drops(cmd *command, codec commandCodec) bool {
+	for _, name := range o.Drop {
+		name = strings.TrimSpace(name)
+
+		if strings.EqualFold(name, cmd.name) || (strings.EqualFold(name, "@write") && codec.isWrite(cmd)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewrite replaces prefix of command keys
+func (o CommandOptions) rewrite(cmd *command) {
+	from, to, ok := strings.Cut(o.RewriteKeys, "=")
+
+	if !ok {
+		return
+	}
+
+	for _, i := range cmd.keys {
+		if key := string(cmd.args[i]); strings.HasPrefix(key, from) {
+			cmd.args[i] = []byte(to + key[len(from):])
+		}
+	}
+}
+
+// command parsed from client stream
+type command struct {
+	name string   // Upper case for Redis, lower case for Memcached, as written by clients
+	args [][]byte // Including name
+	keys []int    // Indexes of args which are keys
+	data []byte   // Data block of Memcached storage commands
+
+	noreply bool // Host does not respond to command
+
+	sent time.Time
+}
+
+// commandCodec implements protocol of host
+type commandCodec interface {
+	// parse returns complete commands at the beginning of buf and number of bytes they take
+	parse(buf []byte) (commands []*command, n int, err error)
+
+	// encode returns bytes of command to send
+	encode(cmd *command) []byte
+
+	// reply returns size of complete reply at the beginning of buf, 0 if reply incomplete.
+	// Error replies are returned as failure, err returned if reply can't be parsed.
+	reply(buf []byte) (n int, failure string, err error)
+
+	isWrite(cmd *command) bool
+}
+
+// codec returns protocol of redis:// or memcached:// host, nil for others
+func (h *ForwardHost) codec() commandCodec {
+	switch h.base.Scheme {
+	case "redis":
+		return redisCodec{}
+	case "memcached":
+		return memcachedCodec{}
+	}
+
+	return nil
+}
+
+// commandStream parses commands of client stream and matches replies of host to them
+type commandStream struct {
+	codec   commandCodec
+	options CommandOptions
+	client  string // Original client IP
+
+	buf []byte // Incomplete command, owned by replayStream()
+
+	dryRun bool // Nothing is sent in dry run, so commands do not wait for replies
+
+	mu      sync.Mutex
+	pending []*command // Sent commands waiting for reply
+}
+
+func newCommandStream(host *ForwardHost, client string) *commandStream {
+	return &commandStream{codec: host.codec(), options: host.Commands, client: client}
+}
+
+// write returns bytes of commands in data which should be sent, and number of dropped commands
+//
+// Sent commands are queued to wait for replies, so write should be called right before sending.
+func (c *commandStream) write(data []byte) (out []byte, dropped int, err error) {
+	c.buf = append(c.buf, data...)
+
+	commands, n, err := c.codec.parse(c.buf)
+	c.buf = c.buf[n:]
+
+	if err != nil {
+		// Position of next command is unknown
+		c.buf = nil
+	}
+
+	now := time.Now()
+
+	for _, cmd := range commands {
+		if c.options.drops(cmd, c.codec) {
+			dropped++
+			continue
+		}
+
+		c.options.rewrite(cmd)
+		out = append(out, c.codec.encode(cmd)...)
+
+		if !cmd.noreply && !c.dryRun {
+			cmd.sent = now
+
+			c.mu.Lock()
+			c.pending = append(c.pending, cmd)
+			c.mu.Unlock()
+		}
+	}
+
+	return
+}
+
+// pop returns earliest command waiting for reply
+func (c *commandStream) pop() *command {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	cmd := c.pending[0]
+	c.pending = c.pending[1:]
+
+	return cmd
+}
+
+// commandReply describes reply to command, sent by readReplies() to handleRequests()
+type commandReply struct {
+	host    *ForwardHost
+	client  string
+	name    string
+	elapsed time.Duration
+	err     error // Error reply
+}
+
+// readReplies reads replies of host until connection closed
+func (f *RequestFactory) readReplies(host *ForwardHost, c *commandStream, conn io.Reader) {
+	var buf []byte
+	read := make([]byte, 4096)
+
+	for {
+		n, err := conn.Read(read)
+
+		if err != nil {
+			return
+		}
+
+		buf = append(buf, read[:n]...)
+
+		for {
+			size, failure, err := c.codec.reply(buf)
+
+			if err != nil {
+				debug(f.verbose, "Error while parsing reply:", host.Url, err)
+				return
+			}
+
+			if size == 0 {
+				break
+			}
+
+			buf = buf[size:]
+
+			cmd := c.pop()
+
+			if cmd == nil {
+				continue
+			}
+
+			reply := &commandReply{host: host, client: c.client, name: cmd.name, elapsed: time.Since(cmd.sent)}
+
+			if failure != "" {
+				reply.err = errors.New(failure)
+			}
+
+			select {
+			case f.c_replies <- reply:
+			case <-f.c_close:
+				return
+			}
+		}
+	}
+}
+
+// handleReply updates stats, called by handleRequests()
+func (f *RequestFactory) handleReply(reply *commandReply) {
+	reply.host.Stat.IncCommand(reply)
+	f.summary.IncCommand(reply)
+
+	if reply.err != nil {
+		f.recordError(reply.host, reply.host.Url+" "+reply.name, reply.client, reply.err)
+	}
+}
+
+// argIndexes returns indexes of arguments from first to last (exclusive) with given step
+func argIndexes(from, to, step int) (indexes []int) {
+	for i := from; i < to; i += step {
+		indexes = append(indexes, i)
+	}
+
+	return
+}
+
+// commandSet returns set of space separated names
+func commandSet(names string) map[string]bool {
+	set := make(map[string]bool)
+
+	for _, name := range strings.Fields(names) {
+		set[name] = true
+	}
+
+	return set
+}
@@ -0,0 +1,149 @@
+package replay
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Session cookie mapping
+//
+// Replayed requests carry production cookies, which forward host doesn't know. If host has MapCookies
+// enabled, cookies set by host responses are remembered per client, and later requests of the same
+// client get production cookie values replaced by values host has set:
+//
+//	login:  request without session cookie   -> host responds "Set-Cookie: session=S"
+//	cart:   request with "Cookie: session=P" -> P bound to S, and forwarded as "Cookie: session=S"
+//	logout: host responds with expired cookie -> mapping removed
+//
+// Client is defined by Affinity if set, or by client IP captured by listener. Use Affinity
+// so that multi-step flows are replayed in order.
+
+// Jars not used for sessionTTL are forgotten
+const sessionTTL = 30 * time.Minute
+
+// cookieJar holds cookie mapping of one client on one host, owned by handleRequests()
+type cookieJar struct {
+	cookies map[string]*mappedCookie // By cookie name
+	used    time.Time
+}
+
+type mappedCookie struct {
+	production string // Empty until first request of client with this cookie
+	host       string // Value set by forward host
+}
+
+type jarKey struct {
+	host   string // Host Url, so mapping survives reload
+	client string
+}
+
+type clientCtxKey struct{}
+
+// withClient returns request with key of client it belongs to
+func withClient(request *http.Request, client string) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), clientCtxKey{}, client))
+}
+
+func requestClient(request *http.Request) string {
+	client, _ := request.Context().Value(clientCtxKey{}).(string)
+	return client
+}
+
+// mapCookies replaces production cookie values of request by ones set by host
+func (f *RequestFactory) mapCookies(host *ForwardHost, request *http.Request) {
+	if !host.MapCookies {
+		return
+	}
+
+	jar, ok := f.jars[jarKey{host.Url, requestClient(request)}]
+
+	if !ok {
+		return
+	}
+
+	jar.used = time.Now()
+
+	cookies := request.Cookies()
+	values := make([]string, len(cookies))
+	changed := false
+
+	for i, cookie := range cookies {
+		if mapped, ok := jar.cookies[cookie.Name]; ok {
+			if mapped.production == "" {
+				mapped.production = cookie.Value
+			}
+
+			// Other production value means client has another session, which host doesn't know
+			if mapped.production == cookie.Value && mapped.host != cookie.Value {
+				cookie.Value = mapped.host
+				changed = true
+			}
+		}
+
+		values[i] = cookie.Name + "=" + cookie.Value
+	}
+
+	// Untouched header forwarded as is
+	if changed {
+		request.Header.Set("Cookie", strings.Join(values, "; "))
+	}
+}
+
+// observeCookies remembers cookies set by host response
+func (f *RequestFactory) observeCookies(resp *HttpResponse) {
+	if !resp.host.MapCookies || resp.resp == nil {
+		return
+	}
+
+	client := requestClient(resp.req)
+
+	if client == "" {
+		return
+	}
+
+	key := jarKey{resp.host.Url, client}
+
+	for _, cookie := range resp.resp.Cookies() {
+		jar, ok := f.jars[key]
+
+		if !ok {
+			jar = &cookieJar{cookies: make(map[string]*mappedCookie)}
+			f.jars[key] = jar
+		}
+
+		jar.used = time.Now()
+
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now())) {
+			delete(jar.cookies, cookie.Name)
+			continue
+		}
+
+		mapped, ok := jar.cookies[cookie.Name]
+
+		if !ok {
+			mapped = &mappedCookie{}
+			jar.cookies[cookie.Name] = mapped
+		}
+
+		mapped.host = cookie.Value
+	}
+
+	f.expireJars()
+}
+
+// expireJars forgets clients not seen for sessionTTL, checked at most once a minute
+func (f *RequestFactory) expireJars() {
+	if time.Since(f.jarsExpired) < time.Minute {
+		return
+	}
+
+	f.jarsExpired = time.Now()
+
+	for key, jar := range f.jars {
+		if time.Since(jar.used) > sessionTTL {
+			delete(f.jars, key)
+		}
+	}
+}
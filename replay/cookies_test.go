@@ -0,0 +1,61 @@
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMapCookies(t *testing.T) {
+	var mu sync.Mutex
+	sessions := make(map[string]string) // Cookie received by /cart, by client
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := r.Header.Get("X-Client")
+
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "staging-" + client})
+		case "/cart":
+			mu.Lock()
+			sessions[client] = r.Header.Get("Cookie")
+			mu.Unlock()
+		}
+	}))
+	defer server.Close()
+
+	settings := ReplaySettings{ForwardAddress: server.URL, ForwardCookies: true}
+	hosts, _ := settings.ForwardedHosts()
+	factory := NewRequestFactory(hosts, false)
+	factory.SetAffinity("ip", 10*time.Millisecond)
+	defer factory.Close()
+
+	add := func(ip string, data string) {
+		request, _ := ParseRequest([]byte(data))
+		factory.Add(withMeta(request, MessageMeta{ClientIP: ip}))
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		add(ip, "GET /login HTTP/1.1\r\nHost: www.w3.org\r\nX-Client: "+ip+"\r\n\r\n")
+		add(ip, "GET /cart HTTP/1.1\r\nHost: www.w3.org\r\nX-Client: "+ip+"\r\nCookie: lang=en; session=production-"+ip+"\r\n\r\n")
+	}
+
+	// Client which never logged in on host
+	add("10.0.0.3", "GET /cart HTTP/1.1\r\nHost: www.w3.org\r\nX-Client: 10.0.0.3\r\nCookie: session=production\r\n\r\n")
+
+	factory.inFlight.Wait()
+
+	expected := map[string]string{
+		"10.0.0.1": "lang=en; session=staging-10.0.0.1",
+		"10.0.0.2": "lang=en; session=staging-10.0.0.2",
+		"10.0.0.3": "session=production",
+	}
+
+	for client, cookie := range expected {
+		if sessions[client] != cookie {
+			t.Error("Wrong cookie of", client, sessions[client])
+		}
+	}
+}
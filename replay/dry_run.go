@@ -0,0 +1,147 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Dry run
+//
+// With DryRun setting requests go through the whole pipeline (parsing, routing, filters, header and cookie
+// rewriting, rate limits), but instead of sending them, final requests are printed:
+//
+//	=> http://staging.server client=10.0.0.1
+//	POST http://staging.server/api/users?id=1
+//	Host: production.com
+//	Content-Type: application/json
+//	(body: 123 bytes)
+//
+// Data of tcp://, redis:// and memcached:// streams is printed after dropping and rewriting commands.
+// WebSocket upgrade is assumed accepted, so client frames are printed too.
+// Nothing is sent to forward hosts, so stats contain only forwarded and dropped counts.
+
+// Longest part of stream data printed
+const dryRunDataLimit = 256
+
+// dryRun prints requests instead of sending them
+type dryRun struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	file   *os.File // Set if output is a file
+	closed bool     // Requests printed after Close are dropped
+}
+
+// newDryRun writes to given file, or to stdout if path is empty
+func newDryRun(path string) (*dryRun, error) {
+	if path == "" {
+		return &dryRun{w: os.Stdout}, nil
+	}
+
+	file, err := os.Create(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &dryRun{w: file, file: file}, nil
+}
+
+// request prints request which would be sent to host
+func (d *dryRun) request(host *ForwardHost, request *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	fmt.Fprintln(d.w, "=>", host.Url, "client="+Meta(request).ClientIP)
+	fmt.Fprintln(d.w, request.Method, request.URL.String())
+
+	if request.Host != "" {
+		fmt.Fprintln(d.w, "Host:", request.Host)
+	}
+
+	names := make([]string, 0, len(request.Header))
+
+	for name := range request.Header {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range request.Header[name] {
+			fmt.Fprintln(d.w, name+":", value)
+		}
+	}
+
+	fmt.Fprintf(d.w, "(body: %d bytes)\n\n", request.ContentLength)
+}
+
+// data prints stream data which would be sent to host
+func (d *dryRun) data(host *ForwardHost, client string, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	fmt.Fprintln(d.w, "=>", host.Url, "client="+client)
+
+	if len(data) > dryRunDataLimit {
+		fmt.Fprintf(d.w, "%q... (%d bytes)\n\n", data[:dryRunDataLimit], len(data))
+	} else {
+		fmt.Fprintf(d.w, "%q (%d bytes)\n\n", data, len(data))
+	}
+}
+
+// Close waits for request being printed, and closes output file
+func (d *dryRun) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+
+	if d.file != nil {
+		return d.file.Close()
+	}
+
+	return nil
+}
+
+// dryRunConn is a connection to host in dry run, writes are printed and reads wait until connection closed
+type dryRunConn struct {
+	dryRun *dryRun
+	host   *ForwardHost
+	client string
+
+	c_closed chan bool
+	once     sync.Once
+}
+
+// conn returns connection which prints stream data of client sent to host
+func (d *dryRun) conn(host *ForwardHost, client string) *dryRunConn {
+	return &dryRunConn{dryRun: d, host: host, client: client, c_closed: make(chan bool)}
+}
+
+func (c *dryRunConn) Write(data []byte) (int, error) {
+	c.dryRun.data(c.host, c.client, data)
+	return len(data), nil
+}
+
+func (c *dryRunConn) Read(data []byte) (int, error) {
+	<-c.c_closed
+	return 0, io.EOF
+}
+
+func (c *dryRunConn) Close() error {
+	c.once.Do(func() { close(c.c_closed) })
+	return nil
+}
@@ -0,0 +1,162 @@
+package replay
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDryRun(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	forward := mockForwardServer(received)
+	defer forward.Close()
+
+	settings := ReplaySettings{
+		ForwardAddress:      forward.URL + "|1," + "redis://127.0.0.1:1",
+		ForwardHeaders:      HeaderOptions{MarkReplayed: true},
+		ForwardDropCommands: "FLUSHALL",
+		ForwardCommands:     CommandOptions{RewriteKeys: "=staging:"},
+	}
+	hosts, err := settings.ForwardedHosts()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	factory := NewRequestFactory(hosts, false)
+	factory.dryRun = &dryRun{w: &out}
+	defer factory.Close()
+
+	// Second request dropped by rate limit
+	for i := 0; i < 2; i++ {
+		request, _ := ParseRequest([]byte("POST /api?id=1 HTTP/1.1\r\nHost: production.com\r\nContent-Length: 5\r\n\r\nhello"))
+		factory.Add(withMeta(request, MessageMeta{ClientIP: "10.0.0.1"}))
+	}
+
+	factory.inFlight.Wait()
+
+	factory.AddTCPMessage(MessageMeta{ClientIP: "10.0.0.1", ClientPort: 51234, FirstPacket: time.Now()}, []byte("FLUSHALL\r\nGET a\r\n"))
+
+	expected := "=> " + forward.URL + " client=10.0.0.1\n" +
+		"POST " + forward.URL + "/api?id=1\n" +
+		"Host: production.com\n" +
+		"Content-Length: 5\n" +
+		"X-Gor-Replayed: 1\n" +
+		"(body: 5 bytes)\n\n" +
+		"=> redis://127.0.0.1:1 client=10.0.0.1\n" +
+		"\"*2\\r\\n$3\\r\\nGET\\r\\n$9\\r\\nstaging:a\\r\\n\" (28 bytes)\n\n"
+
+	for i := 0; i < 50; i++ {
+		factory.dryRun.mu.Lock()
+		output := out.String()
+		factory.dryRun.mu.Unlock()
+
+		if output == expected {
+			break
+		}
+
+		if i == 49 {
+			t.Fatalf("Wrong dry run output: %q", output)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if len(received) != 0 {
+		t.Error("Requests should not be sent in dry run")
+	}
+
+	// Replies are not read in dry run, so commands should not wait for them
+	factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		for _, s := range factory.streams {
+			if len(s.commands.pending) != 0 {
+				t.Error("Commands should not be queued for replies in dry run", len(s.commands.pending))
+			}
+		}
+
+		return hosts
+	})
+
+	if totals := factory.summary.HostTotals(hosts[0]); totals.Forwarded != 1 || totals.Dropped != 1 || len(totals.Codes) != 0 {
+		t.Error("Wrong totals", totals.Forwarded, totals.Dropped, totals.Codes)
+	}
+}
+
+func TestDryRunWebSocket(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	forward := mockForwardServer(received)
+	defer forward.Close()
+
+	hosts, err := (&ReplaySettings{ForwardAddress: forward.URL, ForwardWebSocket: true}).ForwardedHosts()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	factory := NewRequestFactory(hosts, false)
+	factory.dryRun = &dryRun{w: &out}
+	defer factory.Close()
+
+	meta := MessageMeta{ClientIP: "10.0.0.1", ClientPort: 51234, FirstPacket: time.Now()}
+
+	request, _ := ParseRequest([]byte("GET /chat HTTP/1.1\r\nHost: production.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	factory.Add(withMeta(request, meta))
+
+	meta.LastPacket = meta.FirstPacket.Add(10 * time.Millisecond)
+	factory.AddFrame(meta, []byte("\x81\x05hello"))
+
+	expected := "\n=> " + forward.URL + " client=10.0.0.1\n\"\\x81\\x05hello\" (7 bytes)\n\n"
+
+	for i := 0; i < 50; i++ {
+		factory.dryRun.mu.Lock()
+		output := out.String()
+		factory.dryRun.mu.Unlock()
+
+		if strings.HasPrefix(output, "=> "+forward.URL+" client=10.0.0.1\nGET "+forward.URL+"/chat\n") && strings.HasSuffix(output, expected) {
+			break
+		}
+
+		if i == 49 {
+			t.Fatalf("Frames should be printed in dry run: %q", output)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if len(received) != 0 {
+		t.Error("Upgrade request should not be sent in dry run")
+	}
+}
+
+func TestDryRunOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.txt")
+
+	server, err := NewServer(ReplaySettings{Address: "127.0.0.1:0", ForwardAddress: "http://staging.server", DryRun: true, DryRunOutput: path, DrainTimeout: time.Second})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := ParseRequest([]byte("GET / HTTP/1.1\r\nHost: production.com\r\n\r\n"))
+	server.factory.Add(request)
+
+	var connections sync.WaitGroup
+
+	server.listener.Close()
+	server.drain(&connections)
+
+	data, _ := os.ReadFile(path)
+
+	if !strings.HasPrefix(string(data), "=> http://staging.server client=\nGET http://staging.server/\n") {
+		t.Errorf("Dry run should be written to file: %q", data)
+	}
+}
@@ -0,0 +1,98 @@
+package replay
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// gRPC replay
+//
+// gRPC calls are HTTP/2 POST requests to /<package.Service>/<Method> with "application/grpc" content type,
+// captured by listener from h2c connections as other HTTP/2 requests. Body contains length-prefixed messages
+// and is forwarded as is, together with call metadata (headers).
+//
+// grpc:// (h2c) and grpcs:// (TLS) hosts receive only gRPC calls, always over HTTP/2. Result of each call is
+// taken from grpc-status trailer, calls with non-zero status are counted as errors of their method.
+
+// grpcResult is outcome of gRPC call
+type grpcResult struct {
+	method  string // /package.Service/Method
+	status  string // "0" is OK, https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+	message string
+}
+
+func (r *grpcResult) failed() bool {
+	return r.status != "0"
+}
+
+func (r *grpcResult) err() error {
+	if r.status == "" {
+		return errors.New("grpc-status missing")
+	}
+
+	return errors.New("grpc-status " + r.status + ": " + r.message)
+}
+
+// isGRPC returns true if request is a gRPC call
+func isGRPC(request *http.Request) bool {
+	return strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcScheme converts grpc:// and grpcs:// hosts into HTTP/2 ones
+func (h *ForwardHost) grpcScheme() {
+	switch h.base.Scheme {
+	case "grpc":
+		h.base.Scheme = "http"
+	case "grpcs":
+		h.base.Scheme = "https"
+	default:
+		return
+	}
+
+	h.grpc = true
+	h.HTTP2 = true
+}
+
+// acceptsCall returns false for requests which should not be sent to host because of gRPC options
+func (h *ForwardHost) acceptsCall(request *http.Request) bool {
+	if !isGRPC(request) {
+		return !h.grpc
+	}
+
+	if len(h.GRPCMethods) == 0 {
+		return true
+	}
+
+	// /package.Service/Method
+	service, method, _ := strings.Cut(strings.TrimPrefix(request.URL.Path, "/"), "/")
+
+	for _, allowed := range h.GRPCMethods {
+		allowed = strings.Trim(strings.TrimSpace(allowed), "/")
+
+		if allowed == service || allowed == service+"/"+method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readGRPCResult reads response till the end, since status of call is sent in trailers
+func readGRPCResult(request *http.Request, resp *http.Response) *grpcResult {
+	io.Copy(io.Discard, resp.Body)
+
+	result := &grpcResult{method: request.URL.Path}
+
+	// Calls failed without response messages have status in headers ("Trailers-Only" response)
+	for _, h := range []http.Header{resp.Trailer, resp.Header} {
+		if status := h.Get("Grpc-Status"); status != "" {
+			result.status = status
+			result.message = h.Get("Grpc-Message")
+			break
+		}
+	}
+
+	return result
+}
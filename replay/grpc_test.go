@@ -0,0 +1,109 @@
+package replay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestForwardGRPC(t *testing.T) {
+	type call struct {
+		path  string
+		proto int
+		te    string
+		body  string
+	}
+
+	calls := make(chan call, 10)
+
+	grpcServer := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		calls <- call{r.URL.Path, r.ProtoMajor, r.Header.Get("Te"), string(body)}
+
+		w.Header().Set("Content-Type", "application/grpc")
+
+		// Trailers-Only response
+		if r.URL.Path == "/shop.Cart/Fail" {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "not found")
+			return
+		}
+
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("\x00\x00\x00\x00\x00"))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer grpcServer.Close()
+
+	httpRequests := make(chan string, 10)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpRequests <- r.URL.Path
+	}))
+	defer httpServer.Close()
+
+	settings := ReplaySettings{
+		ForwardAddress:     "grpc://" + grpcServer.Listener.Addr().String(),
+		ForwardGRPCMethods: "shop.Cart",
+		Hosts:              []*ForwardHost{{Url: httpServer.URL}},
+	}
+	hosts, err := settings.ForwardedHosts()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	factory := NewRequestFactory(hosts, false)
+	defer factory.Close()
+
+	// Calls captured from h2c connection, converted by listener
+	for _, path := range []string{"/shop.Cart/Add", "/shop.Cart/Fail", "/shop.Orders/Get"} {
+		request, _ := ParseRequest([]byte("POST " + path + " HTTP/1.1\r\nHost: svc\r\ncontent-type: application/grpc\r\nte: trailers\r\nContent-Length: 7\r\n\r\n\x00\x00\x00\x00\x02\x08\x01"))
+		factory.Add(withMeta(request, MessageMeta{ClientIP: "10.0.0.1"}))
+	}
+
+	request, _ := ParseRequest([]byte("GET /index HTTP/1.1\r\nHost: svc\r\n\r\n"))
+	factory.Add(request)
+	factory.inFlight.Wait()
+
+	if len(calls) != 2 {
+		t.Fatal("Only calls of allowed service should be forwarded to grpc:// host", len(calls))
+	}
+
+	for i := 0; i < 2; i++ {
+		if c := <-calls; (c.path != "/shop.Cart/Add" && c.path != "/shop.Cart/Fail") || c.proto != 2 || c.te != "trailers" || c.body != "\x00\x00\x00\x00\x02\x08\x01" {
+			t.Errorf("Wrong call: %+v", c)
+		}
+	}
+
+	// Plain HTTP hosts receive all requests
+	if len(httpRequests) != 4 {
+		t.Error("All requests should be forwarded to http host", len(httpRequests))
+	}
+
+	totals := factory.summary.HostTotals(hosts[0])
+
+	if add, fail := totals.Commands["/shop.Cart/Add"], totals.Commands["/shop.Cart/Fail"]; add == nil || fail == nil || add.Errors != 0 || fail.Errors != 1 || len(totals.Commands) != 2 {
+		t.Fatal("Wrong method totals", totals.Commands)
+	}
+
+	var errors []*RequestError
+
+	factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		for _, e := range factory.errors {
+			if e.Host == hosts[0].Url {
+				errors = append(errors, e)
+			}
+		}
+
+		return hosts
+	})
+
+	if len(errors) != 1 || errors[0].Error != "grpc-status 5: not found" {
+		t.Error("Failed call should be recorded", errors)
+	}
+}
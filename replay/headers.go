@@ -0,0 +1,60 @@
+package replay
+
+import "net/http"
+
+// HeaderOptions control headers of forwarded requests
+//
+// By default requests are forwarded with original headers, including Host.
+type HeaderOptions struct {
+	RewriteHost  bool // Set Host header to forward host instead of original one
+	MarkReplayed bool // Add "X-Gor-Replayed: 1", so forward host can distinguish mirrored traffic
+	Forwarded    bool // Add X-Forwarded-For with original client IP, and X-Forwarded-Host with original Host
+
+	// Send chunked request body with Content-Length instead, trailers are moved to headers.
+	// By default chunked requests are forwarded chunked, with their trailers.
+	Dechunk bool
+}
+
+// apply modifies headers of request already pointing to forward host
+func (o HeaderOptions) apply(request *http.Request) {
+	// Upgrade to HTTP/2 was done by original client, requests of upgraded connection captured separately
+	if request.Header.Get("Upgrade") == "h2c" {
+		request.Header.Del("Upgrade")
+		request.Header.Del("HTTP2-Settings")
+		request.Header.Del("Connection")
+	}
+
+	if o.Forwarded {
+		if ip := Meta(request).ClientIP; ip != "" {
+			if prior := request.Header.Get("X-Forwarded-For"); prior != "" {
+				ip = prior + ", " + ip
+			}
+
+			request.Header.Set("X-Forwarded-For", ip)
+		}
+
+		request.Header.Set("X-Forwarded-Host", request.Host)
+	}
+
+	if o.RewriteHost {
+		request.Host = request.URL.Host
+	}
+
+	if o.MarkReplayed {
+		request.Header.Set("X-Gor-Replayed", "1")
+	}
+
+	// Body is already buffered, so ContentLength is known
+	if o.Dechunk && len(request.TransferEncoding) > 0 {
+		request.TransferEncoding = nil
+
+		for name, values := range request.Trailer {
+			for _, value := range values {
+				request.Header.Add(name, value)
+			}
+		}
+
+		request.Trailer = nil
+		request.Header.Del("Trailer")
+	}
+}
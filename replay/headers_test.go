@@ -0,0 +1,78 @@
+package replay
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseMeta(t *testing.T) {
+	meta, message := parseMeta([]byte("GOR-META client_ip=10.0.0.1 client_port=51234 server_ip=10.0.0.2 server_port=80 first_packet=1000 last_packet=2000 proto=websocket unknown=1\nGET / HTTP/1.1\r\n\r\n"))
+
+	expected := MessageMeta{"10.0.0.1", 51234, "10.0.0.2", 80, time.Unix(0, 1000), time.Unix(0, 2000), "websocket"}
+
+	if meta != expected || string(message) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Error("Meta line should be parsed and removed", meta, string(message))
+	}
+
+	meta, message = parseMeta([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	if meta.ClientIP != "" || string(message) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Error("Message without meta should be returned as is", meta, string(message))
+	}
+}
+
+func TestHeaderOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options HeaderOptions
+		host    string
+		headers map[string]string
+	}{
+		{"default", HeaderOptions{}, "www.w3.org", map[string]string{"X-Gor-Replayed": "", "X-Forwarded-For": "192.168.0.1"}},
+		{"rewrite host", HeaderOptions{RewriteHost: true}, "staging.server", nil},
+		{"mark replayed", HeaderOptions{MarkReplayed: true}, "www.w3.org", map[string]string{"X-Gor-Replayed": "1"}},
+		{"forwarded", HeaderOptions{Forwarded: true, RewriteHost: true}, "staging.server", map[string]string{
+			"X-Forwarded-For":  "192.168.0.1, 10.0.0.1",
+			"X-Forwarded-Host": "www.w3.org",
+		}},
+	}
+
+	for _, tt := range tests {
+		request, _ := ParseRequest([]byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\nX-Forwarded-For: 192.168.0.1\r\n\r\n"))
+		request = withMeta(request, MessageMeta{ClientIP: "10.0.0.1"})
+		request.URL = &url.URL{Scheme: "http", Host: "staging.server", Path: "/"}
+
+		tt.options.apply(request)
+
+		if request.Host != tt.host {
+			t.Error(tt.name, "Wrong Host header", request.Host)
+		}
+
+		for name, value := range tt.headers {
+			if got := request.Header.Get(name); got != value {
+				t.Error(tt.name, "Wrong", name, "header:", got)
+			}
+		}
+	}
+}
+
+func TestHeaderOptionsForwarded(t *testing.T) {
+	received := make(chan *http.Request, 1)
+
+	server := mockForwardServer(received)
+	defer server.Close()
+
+	settings := ReplaySettings{ForwardAddress: server.URL, ForwardHeaders: HeaderOptions{MarkReplayed: true, Forwarded: true}}
+	hosts, _ := settings.ForwardedHosts()
+	factory := NewRequestFactory(hosts, false)
+	defer factory.Close()
+
+	factory.Add(withMeta(getRequest(), MessageMeta{ClientIP: "10.0.0.1"}))
+	r := <-received
+
+	if r.Header.Get("X-Forwarded-For") != "10.0.0.1" || r.Header.Get("X-Gor-Replayed") != "1" || r.Host != "www.w3.org" {
+		t.Error("Headers should be added to forwarded request", r.Host, r.Header)
+	}
+}
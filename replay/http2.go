@@ -0,0 +1,33 @@
+package replay
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// http2Transport returns transport which always uses HTTP/2
+//
+// For http:// hosts it connects without TLS and without upgrade (h2c with prior knowledge).
+func (host *ForwardHost) http2Transport() (http.RoundTripper, error) {
+	config, err := host.TLS.config()
+
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http2.Transport{TLSClientConfig: config}
+
+	if host.base.Scheme == "http" {
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	return transport, nil
+}
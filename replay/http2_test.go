@@ -0,0 +1,49 @@
+package replay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestForwardHTTP2(t *testing.T) {
+	type forwarded struct {
+		proto int
+		body  string
+	}
+
+	received := make(chan forwarded, 1)
+
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- forwarded{r.ProtoMajor, string(body)}
+	}), &http2.Server{}))
+	defer server.Close()
+
+	for _, useHTTP2 := range []bool{false, true} {
+		settings := ReplaySettings{ForwardAddress: server.URL, ForwardHTTP2: useHTTP2}
+		hosts, err := settings.ForwardedHosts()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		factory := NewRequestFactory(hosts, false)
+
+		// Request captured from HTTP/2 connection, converted by listener
+		request, _ := ParseRequest([]byte("POST /post HTTP/1.1\r\nHost: svc\r\nContent-Length: 5\r\n\r\nhello"))
+		factory.Add(withMeta(request, MessageMeta{}))
+
+		r := <-received
+		factory.inFlight.Wait()
+		factory.Close()
+
+		if expected := map[bool]int{false: 1, true: 2}[useHTTP2]; r.proto != expected || r.body != "hello" {
+			t.Error("Wrong protocol or body", useHTTP2, r)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Memcached text protocol, https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+//
+// Binary protocol and quiet mode of meta commands are not supported.
+type memcachedCodec struct{}
+
+var errMemcached = errors.New("malformed Memcached data")
+
+// Commands followed by data block, position of its size in command line
+var memcachedStorage = map[string]int{"set": 4, "add": 4, "replace": 4, "append": 4, "prepend": 4, "cas": 4, "ms": 2}
+
+var memcachedWrites = commandSet(`set add replace append prepend cas delete incr decr touch gat gats flush_all ms md ma`)
+
+func (memcachedCodec) parse(buf []byte) (commands []*command, n int, err error) {
+	for n < len(buf) {
+		line, size := redisLine(buf[n:])
+
+		if size == 0 {
+			return
+		}
+
+		fields := bytes.Fields(line)
+
+		if len(fields) == 0 {
+			n += size
+			continue
+		}
+
+		cmd := &command{name: strings.ToLower(string(fields[0]))}
+
+		for _, field := range fields {
+			cmd.args = append(cmd.args, append([]byte(nil), field...))
+		}
+
+		if i, ok := memcachedStorage[cmd.name]; ok {
+			if len(fields) <= i {
+				return commands, n, errMemcached
+			}
+
+			length, err := strconv.Atoi(string(fields[i]))
+
+			if err != nil || length < 0 {
+				return commands, n, errMemcached
+			}
+
+			if len(buf) < n+size+length+2 {
+				return commands, n, nil
+			}
+
+			cmd.data = append([]byte(nil), buf[n+size:n+size+length]...)
+			size += length + 2
+		}
+
+		switch cmd.name {
+		case "get", "gets":
+			cmd.keys = argIndexes(1, len(cmd.args), 1)
+		case "gat", "gats":
+			cmd.keys = argIndexes(2, len(cmd.args), 1)
+		case "set", "add", "replace", "append", "prepend", "cas", "delete", "incr", "decr", "touch", "mg", "ms", "md", "ma":
+			if len(cmd.args) > 1 {
+				cmd.keys = []int{1}
+			}
+		}
+
+		cmd.noreply = cmd.name == "quit" || string(fields[len(fields)-1]) == "noreply"
+
+		commands = append(commands, cmd)
+		n += size
+	}
+
+	return
+}
+
+func (memcachedCodec) encode(cmd *command) []byte {
+	out := append(bytes.Join(cmd.args, []byte(" ")), "\r\n"...)
+
+	if _, ok := memcachedStorage[cmd.name]; ok {
+		out = append(out, cmd.data...)
+		out = append(out, "\r\n"...)
+	}
+
+	return out
+}
+
+// reply returns size of single line reply, or of VALUE/STAT lines followed by END
+func (memcachedCodec) reply(buf []byte) (n int, failure string, err error) {
+	for {
+		line, size := redisLine(buf[n:])
+
+		if size == 0 {
+			return 0, "", nil
+		}
+
+		n += size
+		fields := strings.Fields(string(line))
+
+		if len(fields) == 0 {
+			return 0, "", errMemcached
+		}
+
+		switch fields[0] {
+		case "VALUE", "VA":
+			// VALUE <key> <flags> <bytes> [<cas>], VA <bytes> <flags>*
+			i := 3
+
+			if fields[0] == "VA" {
+				i = 1
+			}
+
+			if len(fields) <= i {
+				return 0, "", errMemcached
+			}
+
+			length, err := strconv.Atoi(fields[i])
+
+			if err != nil || length < 0 {
+				return 0, "", errMemcached
+			}
+
+			if len(buf) < n+length+2 {
+				return 0, "", nil
+			}
+
+			n += length + 2
+
+			// Meta get returns single value
+			if fields[0] == "VA" {
+				return n, "", nil
+			}
+		case "STAT":
+		case "ERROR", "CLIENT_ERROR", "SERVER_ERROR":
+			return n, string(line), nil
+		default:
+			return n, "", nil
+		}
+	}
+}
+
+func (memcachedCodec) isWrite(cmd *command) bool {
+	return memcachedWrites[cmd.name]
+}
@@ -0,0 +1,63 @@
+package replay
+
+import "testing"
+
+func TestMemcachedCodec(t *testing.T) {
+	c := &commandStream{codec: memcachedCodec{}, options: CommandOptions{Drop: []string{"flush_all"}, RewriteKeys: "prod:=staging:"}}
+
+	data := "set prod:a 0 60 5\r\nhello\r\n" +
+		"get prod:a prod:b other\r\n" +
+		"flush_all\r\n" +
+		"delete prod:a noreply\r\n" +
+		"gat 60 prod:a\r\n" +
+		"ms prod:a 2 T60\r\nhi\r\n"
+
+	expected := "set staging:a 0 60 5\r\nhello\r\n" +
+		"get staging:a staging:b other\r\n" +
+		"delete staging:a noreply\r\n" +
+		"gat 60 staging:a\r\n" +
+		"ms staging:a 2 T60\r\nhi\r\n"
+
+	for i := 0; i < len(data); i++ {
+		c.pending = nil
+
+		out, dropped, err := c.write([]byte(data[:i]))
+		rest, droppedRest, _ := c.write([]byte(data[i:]))
+		out = append(out, rest...)
+
+		// Reply to delete is not expected
+		if err != nil || string(out) != expected || dropped+droppedRest != 1 || len(c.pending) != 4 {
+			t.Fatalf("Wrong commands at %d: %q %d %v", i, out, dropped+droppedRest, err)
+		}
+	}
+
+	c.options.Drop = []string{"@WRITE"}
+	c.pending = nil
+
+	if _, dropped, _ := c.write([]byte(data)); dropped != 5 || len(c.pending) != 1 || c.pending[0].name != "get" {
+		t.Error("Writes should be dropped", dropped)
+	}
+}
+
+func TestMemcachedReply(t *testing.T) {
+	for reply, failure := range map[string]string{
+		"STORED\r\n": "",
+		"VALUE prod:a 0 5\r\nhello\r\nVALUE prod:b 0 3 10\r\nEND\r\nEND\r\n": "",
+		"END\r\n":                                "",
+		"STAT pid 1\r\nSTAT uptime 2\r\nEND\r\n": "",
+		"VA 2 t60\r\nhi\r\n":                     "",
+		"CLIENT_ERROR bad data chunk\r\n":        "CLIENT_ERROR bad data chunk",
+	} {
+		for i := 0; i < len(reply); i++ {
+			if n, _, err := (memcachedCodec{}).reply([]byte(reply[:i])); n != 0 || err != nil {
+				t.Errorf("Incomplete reply %q should wait for data: %d %v", reply[:i], n, err)
+			}
+		}
+
+		n, f, err := (memcachedCodec{}).reply([]byte(reply + "STORED\r\n"))
+
+		if n != len(reply) || f != failure || err != nil {
+			t.Errorf("Wrong reply %q: %d %q %v", reply, n, f, err)
+		}
+	}
+}
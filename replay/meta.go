@@ -0,0 +1,93 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MessageMeta describes where and when request was captured, it is sent by listener before request itself:
+//
+//     GOR-META client_ip=10.0.0.1 client_port=51234 server_ip=10.0.0.2 server_port=80 first_packet=<unix nano> last_packet=<unix nano> proto=websocket\n
+//
+// Unknown keys are ignored, and messages without meta line are accepted as is. Missing values are left empty.
+type MessageMeta struct {
+	ClientIP   string // IP address request was sent from
+	ClientPort int
+	ServerIP   string // IP address request was sent to, captured by listener
+	ServerPort int
+
+	FirstPacket time.Time // When first and last TCP packets of request were captured
+	LastPacket  time.Time
+
+	Proto string // "websocket" for WebSocket frame, "tcp" for raw TCP data, empty for HTTP requests
+}
+
+// parseMeta returns meta and message without meta line
+func parseMeta(data []byte) (meta MessageMeta, message []byte) {
+	if !bytes.HasPrefix(data, []byte("GOR-META")) {
+		return meta, data
+	}
+
+	end := bytes.IndexByte(data, '\n')
+
+	if end == -1 {
+		return meta, data
+	}
+
+	for _, field := range strings.Fields(string(data[:end]))[1:] {
+		key, value, _ := strings.Cut(field, "=")
+
+		switch key {
+		case "client_ip":
+			meta.ClientIP = value
+		case "client_port":
+			meta.ClientPort, _ = strconv.Atoi(value)
+		case "server_ip":
+			meta.ServerIP = value
+		case "server_port":
+			meta.ServerPort, _ = strconv.Atoi(value)
+		case "first_packet":
+			meta.FirstPacket = parseUnixNano(value)
+		case "last_packet":
+			meta.LastPacket = parseUnixNano(value)
+		case "proto":
+			meta.Proto = value
+		}
+	}
+
+	return meta, data[end+1:]
+}
+
+func parseUnixNano(value string) time.Time {
+	nsec, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nsec)
+}
+
+// String used for logging
+func (m MessageMeta) String() string {
+	return "client: " + net.JoinHostPort(m.ClientIP, strconv.Itoa(m.ClientPort)) +
+		" server: " + net.JoinHostPort(m.ServerIP, strconv.Itoa(m.ServerPort))
+}
+
+type metaKey struct{}
+
+// withMeta returns request with meta attached
+func withMeta(request *http.Request, meta MessageMeta) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), metaKey{}, meta))
+}
+
+// Meta returns meta of request received from listener
+func Meta(request *http.Request) MessageMeta {
+	meta, _ := request.Context().Value(metaKey{}).(MessageMeta)
+	return meta
+}
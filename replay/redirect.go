@@ -0,0 +1,39 @@
+package replay
+
+import (
+	"context"
+	"net/http"
+)
+
+// RedirectPolicy defines which redirects forward host responses are followed
+//
+// By default redirects are not followed, and 3xx response is recorded as is https://github.com/buger/gor/pull/15
+type RedirectPolicy struct {
+	Max      int  // Maximum number of redirects to follow, 0 means redirects are not followed
+	SameHost bool // Follow only redirects to the same host
+}
+
+// redirectsKey is a context key for counter of redirects followed by request
+type redirectsKey struct{}
+
+// withRedirectsCounter returns request which counts followed redirects into given counter
+func withRedirectsCounter(request *http.Request, counter *int) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), redirectsKey{}, counter))
+}
+
+// checkRedirect used as http.Client CheckRedirect. When redirect not allowed, last response returned without error.
+func (p RedirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.Max {
+		return http.ErrUseLastResponse
+	}
+
+	if p.SameHost && req.URL.Host != via[0].URL.Host {
+		return http.ErrUseLastResponse
+	}
+
+	if counter, ok := req.Context().Value(redirectsKey{}).(*int); ok {
+		*counter++
+	}
+
+	return nil
+}
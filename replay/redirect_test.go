@@ -0,0 +1,66 @@
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectPolicy(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer other.Close()
+
+	// /test -> /a -> /b, and /external redirects to other host
+	forward := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/test":
+			http.Redirect(w, r, "/a", http.StatusFound)
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/external":
+			http.Redirect(w, r, other.URL, http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer forward.Close()
+
+	tests := []struct {
+		name      string
+		path      string
+		policy    RedirectPolicy
+		code      int
+		redirects int
+	}{
+		{"not followed", "/test", RedirectPolicy{}, http.StatusFound, 0},
+		{"follow one", "/test", RedirectPolicy{Max: 1}, http.StatusFound, 1},
+		{"follow all", "/test", RedirectPolicy{Max: 5}, http.StatusOK, 2},
+		{"other host", "/external", RedirectPolicy{Max: 5}, http.StatusAccepted, 1},
+		{"same host only", "/external", RedirectPolicy{Max: 5, SameHost: true}, http.StatusFound, 0},
+	}
+
+	for _, tt := range tests {
+		settings := ReplaySettings{ForwardAddress: forward.URL, ForwardRedirects: tt.policy}
+		hosts, _ := settings.ForwardedHosts()
+
+		factory := NewRequestFactory(hosts, false)
+
+		request, _ := ParseRequest([]byte("GET " + tt.path + " HTTP/1.1\r\nHost: www.w3.org\r\n\r\n"))
+		factory.Add(request)
+		factory.inFlight.Wait()
+
+		totals := factory.summary.HostTotals(hosts[0])
+
+		if totals.Codes[tt.code] != 1 {
+			t.Error(tt.name, "Expected status", tt.code, totals.Codes, totals.Errors)
+		}
+
+		if totals.Redirects != tt.redirects {
+			t.Error(tt.name, "Expected redirects", tt.redirects, totals.Redirects)
+		}
+
+		factory.Close()
+	}
+}
@@ -0,0 +1,306 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Redis protocol (RESP), https://redis.io/docs/reference/protocol-spec/
+//
+// Clients send commands as arrays of bulk strings, or as inline commands ("PING\r\n").
+// Both are replayed as arrays.
+type redisCodec struct{}
+
+var errRESP = errors.New("malformed RESP data")
+
+// Commands without keys, or with keys at positions not known
+var redisNoKeys = commandSet(`PING ECHO SELECT AUTH HELLO INFO CLIENT CONFIG COMMAND DBSIZE TIME
+	FLUSHALL FLUSHDB SWAPDB MULTI EXEC DISCARD UNWATCH QUIT RESET SCAN KEYS RANDOMKEY
+	SAVE BGSAVE BGREWRITEAOF LASTSAVE SHUTDOWN SLAVEOF REPLICAOF ROLE MONITOR WAIT
+	SUBSCRIBE UNSUBSCRIBE PSUBSCRIBE PUNSUBSCRIBE PUBLISH PUBSUB SCRIPT FUNCTION
+	SLOWLOG MEMORY LATENCY DEBUG CLUSTER READONLY READWRITE MODULE ACL`)
+
+// Commands where all arguments are keys
+var redisAllKeys = commandSet(`DEL UNLINK EXISTS MGET TOUCH WATCH RENAME RENAMENX
+	SINTER SUNION SDIFF SINTERSTORE SUNIONSTORE SDIFFSTORE PFCOUNT PFMERGE`)
+
+// Commands where all arguments but last timeout are keys
+var redisBlockingKeys = commandSet(`BLPOP BRPOP BZPOPMIN BZPOPMAX BRPOPLPUSH`)
+
+// Commands with source and destination keys: LMOVE source destination ...
+var redisTwoKeys = commandSet(`LMOVE BLMOVE RPOPLPUSH SMOVE COPY GEOSEARCHSTORE ZRANGESTORE`)
+
+// Commands with number of keys before them, by its position:
+// EVAL script numkeys key [key ...] arg [arg ...], ZUNION numkeys key [key ...] ..., BLMPOP timeout numkeys key [key ...] ...
+var redisNumKeys = map[string]int{
+	"EVAL": 2, "EVALSHA": 2, "EVAL_RO": 2, "EVALSHA_RO": 2, "FCALL": 2, "FCALL_RO": 2,
+	"ZUNION": 1, "ZINTER": 1, "ZDIFF": 1, "ZINTERCARD": 1, "SINTERCARD": 1, "LMPOP": 1, "ZMPOP": 1,
+	"BLMPOP": 2, "BZMPOP": 2,
+}
+
+// Commands storing result of other keys: ZUNIONSTORE destination numkeys key [key ...] ...
+var redisStoreNumKeys = commandSet(`ZUNIONSTORE ZINTERSTORE ZDIFFSTORE`)
+
+var redisWrites = commandSet(`SET SETNX SETEX PSETEX MSET MSETNX APPEND SETRANGE GETSET GETDEL GETEX
+	INCR INCRBY INCRBYFLOAT DECR DECRBY DEL UNLINK EXPIRE EXPIREAT PEXPIRE PEXPIREAT PERSIST
+	RENAME RENAMENX MOVE COPY RESTORE HSET HSETNX HMSET HDEL HINCRBY HINCRBYFLOAT
+	LPUSH LPUSHX RPUSH RPUSHX LPOP RPOP LSET LREM LTRIM LINSERT LMOVE RPOPLPUSH BLPOP BRPOP BLMOVE BRPOPLPUSH
+	SADD SREM SPOP SMOVE SINTERSTORE SUNIONSTORE SDIFFSTORE
+	ZADD ZREM ZINCRBY ZPOPMIN ZPOPMAX BZPOPMIN BZPOPMAX ZREMRANGEBYSCORE ZREMRANGEBYRANK ZREMRANGEBYLEX
+	ZUNIONSTORE ZINTERSTORE ZDIFFSTORE ZRANGESTORE PFADD PFMERGE
+	LMPOP BLMPOP ZMPOP BZMPOP GEOSEARCHSTORE
+	XADD XDEL XTRIM XGROUP XACK XCLAIM XAUTOCLAIM GEOADD SETBIT BITOP BITFIELD
+	FLUSHALL FLUSHDB SWAPDB EVAL EVALSHA FCALL`)
+
+func (redisCodec) parse(buf []byte) (commands []*command, n int, err error) {
+	for n < len(buf) {
+		// Empty lines between inline commands
+		if buf[n] == '\r' || buf[n] == '\n' {
+			n++
+			continue
+		}
+
+		var args [][]byte
+		var size int
+
+		if buf[n] == '*' {
+			args, size, err = redisArray(buf[n:])
+		} else {
+			args, size = redisInline(buf[n:])
+		}
+
+		if err != nil || size == 0 {
+			return
+		}
+
+		n += size
+
+		if len(args) > 0 {
+			commands = append(commands, redisCommand(args))
+		}
+	}
+
+	return
+}
+
+// redisArray parses array of bulk strings, size is 0 if array incomplete
+func redisArray(buf []byte) (args [][]byte, size int, err error) {
+	count, size := redisLine(buf)
+
+	if size == 0 {
+		return nil, 0, nil
+	}
+
+	n, err := strconv.Atoi(string(count[1:]))
+
+	if err != nil || n < 0 {
+		return nil, 0, errRESP
+	}
+
+	for i := 0; i < n; i++ {
+		header, headerSize := redisLine(buf[size:])
+
+		if headerSize == 0 {
+			return nil, 0, nil
+		}
+
+		if len(header) == 0 || header[0] != '$' {
+			return nil, 0, errRESP
+		}
+
+		length, err := strconv.Atoi(string(header[1:]))
+
+		if err != nil || length < 0 {
+			return nil, 0, errRESP
+		}
+
+		start := size + headerSize
+
+		if len(buf) < start+length+2 {
+			return nil, 0, nil
+		}
+
+		args = append(args, buf[start:start+length])
+		size = start + length + 2
+	}
+
+	return args, size, nil
+}
+
+// redisInline parses command sent as a line of space separated arguments
+func redisInline(buf []byte) (args [][]byte, size int) {
+	line, size := redisLine(buf)
+
+	for _, arg := range bytes.Fields(line) {
+		args = append(args, arg)
+	}
+
+	return
+}
+
+// redisLine returns line without CRLF and its size including CRLF, 0 if line incomplete
+func redisLine(buf []byte) (line []byte, size int) {
+	end := bytes.IndexByte(buf, '\n')
+
+	if end == -1 {
+		return nil, 0
+	}
+
+	return bytes.TrimSuffix(buf[:end], []byte("\r")), end + 1
+}
+
+func redisCommand(args [][]byte) *command {
+	// Arguments point into stream buffer, which is reused
+	for i, arg := range args {
+		args[i] = append([]byte(nil), arg...)
+	}
+
+	cmd := &command{name: strings.ToUpper(string(args[0])), args: args}
+
+	switch {
+	case redisNoKeys[cmd.name]:
+	case redisAllKeys[cmd.name]:
+		cmd.keys = argIndexes(1, len(args), 1)
+	case redisBlockingKeys[cmd.name]:
+		cmd.keys = argIndexes(1, len(args)-1, 1)
+	case cmd.name == "MSET" || cmd.name == "MSETNX":
+		cmd.keys = argIndexes(1, len(args), 2)
+	case redisTwoKeys[cmd.name]:
+		cmd.keys = argIndexes(1, min(3, len(args)), 1)
+	case cmd.name == "BITOP":
+		// BITOP operation destkey key [key ...]
+		cmd.keys = argIndexes(2, len(args), 1)
+	case redisNumKeys[cmd.name] != 0:
+		cmd.keys = redisKeysAfterNum(args, redisNumKeys[cmd.name])
+	case redisStoreNumKeys[cmd.name]:
+		cmd.keys = append([]int{1}, redisKeysAfterNum(args, 2)...)
+	case cmd.name == "XREAD" || cmd.name == "XREADGROUP":
+		cmd.keys = redisStreamKeys(args)
+	case len(args) > 1:
+		// Most commands have single key as first argument
+		cmd.keys = []int{1}
+	}
+
+	return cmd
+}
+
+// redisKeysAfterNum returns keys following number of keys at given position
+func redisKeysAfterNum(args [][]byte, at int) []int {
+	if len(args) <= at {
+		return nil
+	}
+
+	numKeys, _ := strconv.Atoi(string(args[at]))
+
+	return argIndexes(at+1, min(at+1+max(numKeys, 0), len(args)), 1)
+}
+
+// redisStreamKeys returns keys of XREAD and XREADGROUP: ... STREAMS key [key ...] id [id ...]
+func redisStreamKeys(args [][]byte) []int {
+	for i := 1; i < len(args); i++ {
+		if strings.EqualFold(string(args[i]), "STREAMS") {
+			return argIndexes(i+1, i+1+(len(args)-i-1)/2, 1)
+		}
+	}
+
+	return nil
+}
+
+func (redisCodec) encode(cmd *command) []byte {
+	out := []byte("*" + strconv.Itoa(len(cmd.args)) + "\r\n")
+
+	for _, arg := range cmd.args {
+		out = append(out, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		out = append(out, arg...)
+		out = append(out, "\r\n"...)
+	}
+
+	return out
+}
+
+func (redisCodec) reply(buf []byte) (n int, failure string, err error) {
+	n, err = redisValue(buf)
+
+	switch {
+	case n == 0:
+	case buf[0] == '-':
+		line, _ := redisLine(buf)
+		failure = string(line[1:])
+	case buf[0] == '!':
+		_, size := redisLine(buf)
+		failure = string(buf[size : n-2])
+	}
+
+	return
+}
+
+// redisValue returns size of complete RESP2 or RESP3 value, 0 if it is incomplete
+func redisValue(buf []byte) (int, error) {
+	line, size := redisLine(buf)
+
+	if size == 0 {
+		return 0, nil
+	}
+
+	if len(line) == 0 {
+		return 0, errRESP
+	}
+
+	switch line[0] {
+	case '+', '-', ':', '_', ',', '#', '(':
+		return size, nil
+	case '$', '!', '=':
+		length, err := strconv.Atoi(string(line[1:]))
+
+		if err != nil {
+			return 0, errRESP
+		}
+
+		// Null bulk string
+		if length < 0 {
+			return size, nil
+		}
+
+		if len(buf) < size+length+2 {
+			return 0, nil
+		}
+
+		return size + length + 2, nil
+	case '*', '~', '>', '%', '|':
+		count, err := strconv.Atoi(string(line[1:]))
+
+		if err != nil {
+			return 0, errRESP
+		}
+
+		// Maps and attributes contain key-value pairs
+		if line[0] == '%' || line[0] == '|' {
+			count *= 2
+		}
+
+		// Attribute is followed by value it describes
+		if line[0] == '|' {
+			count++
+		}
+
+		for i := 0; i < count; i++ {
+			n, err := redisValue(buf[size:])
+
+			if err != nil || n == 0 {
+				return 0, err
+			}
+
+			size += n
+		}
+
+		return size, nil
+	}
+
+	return 0, errRESP
+}
+
+func (redisCodec) isWrite(cmd *command) bool {
+	return redisWrites[cmd.name]
+}
@@ -0,0 +1,241 @@
+package replay
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisCodec(t *testing.T) {
+	c := &commandStream{codec: redisCodec{}, options: CommandOptions{Drop: []string{"flushall", " DEL"}, RewriteKeys: "prod:=staging:"}}
+
+	data := "*3\r\n$3\r\nSET\r\n$6\r\nprod:a\r\n$1\r\n1\r\n" +
+		"get prod:b\r\n" +
+		"*1\r\n$8\r\nFLUSHALL\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$6\r\nprod:a\r\n" +
+		"*4\r\n$4\r\nMGET\r\n$6\r\nprod:a\r\n$5\r\nother\r\n$6\r\nprod:c\r\n" +
+		"*5\r\n$4\r\nMSET\r\n$6\r\nprod:a\r\n$6\r\nprod:b\r\n$6\r\nprod:c\r\n$6\r\nprod:d\r\n" +
+		"*4\r\n$4\r\nEVAL\r\n$6\r\nreturn\r\n$1\r\n1\r\n$6\r\nprod:a\r\n" +
+		"*3\r\n$5\r\nBLPOP\r\n$6\r\nprod:a\r\n$6\r\nprod:0\r\n"
+
+	expected := "*3\r\n$3\r\nSET\r\n$9\r\nstaging:a\r\n$1\r\n1\r\n" +
+		"*2\r\n$3\r\nget\r\n$9\r\nstaging:b\r\n" +
+		"*4\r\n$4\r\nMGET\r\n$9\r\nstaging:a\r\n$5\r\nother\r\n$9\r\nstaging:c\r\n" +
+		"*5\r\n$4\r\nMSET\r\n$9\r\nstaging:a\r\n$6\r\nprod:b\r\n$9\r\nstaging:c\r\n$6\r\nprod:d\r\n" +
+		"*4\r\n$4\r\nEVAL\r\n$6\r\nreturn\r\n$1\r\n1\r\n$9\r\nstaging:a\r\n" +
+		"*3\r\n$5\r\nBLPOP\r\n$9\r\nstaging:a\r\n$6\r\nprod:0\r\n"
+
+	// Commands can be split between messages at any position
+	for i := 0; i < len(data); i++ {
+		c.pending = nil
+
+		out, dropped, err := c.write([]byte(data[:i]))
+		rest, droppedRest, _ := c.write([]byte(data[i:]))
+		out = append(out, rest...)
+
+		if err != nil || string(out) != expected || dropped+droppedRest != 2 || len(c.pending) != 6 || len(c.buf) != 0 {
+			t.Fatalf("Wrong commands at %d: %q %d %v", i, out, dropped+droppedRest, err)
+		}
+	}
+
+	c.options.Drop = []string{"@write"}
+	c.pending = nil
+
+	if out, dropped, _ := c.write([]byte(data)); dropped != 6 || len(c.pending) != 2 || c.pending[0].name != "GET" {
+		t.Errorf("Writes should be dropped: %q %d", out, dropped)
+	}
+
+	tests := []struct {
+		command string
+		keys    []int
+	}{
+		{"GET a", []int{1}},
+		{"LMOVE a b LEFT RIGHT", []int{1, 2}},
+		{"BLMOVE a b LEFT RIGHT 0", []int{1, 2}},
+		{"RPOPLPUSH a b", []int{1, 2}},
+		{"SMOVE a b member", []int{1, 2}},
+		{"COPY a b REPLACE", []int{1, 2}},
+		{"GEOSEARCHSTORE a b FROMMEMBER m BYRADIUS 1 km", []int{1, 2}},
+		{"BITOP AND a b c", []int{2, 3, 4}},
+		{"ZUNIONSTORE a 2 b c WEIGHTS 1 2", []int{1, 3, 4}},
+		{"ZINTERSTORE a 1 b", []int{1, 3}},
+		{"ZDIFFSTORE a 2 b c", []int{1, 3, 4}},
+		{"ZUNION 2 a b WITHSCORES", []int{2, 3}},
+		{"ZINTER 2 a b", []int{2, 3}},
+		{"ZDIFF 1 a", []int{2}},
+		{"SINTERCARD 2 a b LIMIT 5", []int{2, 3}},
+		{"LMPOP 2 a b LEFT COUNT 2", []int{2, 3}},
+		{"ZMPOP 1 a MIN", []int{2}},
+		{"EVAL script 1 a arg", []int{3}},
+		{"EVAL script 5 a", []int{3}},
+		{"XREAD COUNT 2 STREAMS a b 0 0", []int{4, 5}},
+		{"XREADGROUP GROUP g c BLOCK 0 streams a >", []int{7}},
+	}
+
+	for _, tt := range tests {
+		var args [][]byte
+
+		for _, arg := range strings.Fields(tt.command) {
+			args = append(args, []byte(arg))
+		}
+
+		if keys := redisCommand(args).keys; !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("Wrong keys of %q: %v, expected %v", tt.command, keys, tt.keys)
+		}
+	}
+}
+
+func TestRedisReply(t *testing.T) {
+	for reply, failure := range map[string]string{
+		"+OK\r\n":                          "",
+		"-ERR unknown command\r\n":         "ERR unknown command",
+		"$-1\r\n":                          "",
+		"$5\r\nhello\r\n":                  "",
+		"*2\r\n$1\r\na\r\n*1\r\n:1\r\n":    "",
+		"%1\r\n+key\r\n$5\r\nvalue\r\n":    "",
+		"|1\r\n+ttl\r\n:3\r\n+OK\r\n":      "",
+		"!21\r\nSYNTAX invalid syntax\r\n": "SYNTAX invalid syntax",
+		"*3\r\n:1\r\n_\r\n,1.5\r\n":        "",
+		"~2\r\n#t\r\n(12345678901234\r\n":  "",
+	} {
+		for i := 0; i < len(reply); i++ {
+			if n, _, err := (redisCodec{}).reply([]byte(reply[:i])); n != 0 || err != nil {
+				t.Errorf("Incomplete reply %q should wait for data: %d %v", reply[:i], n, err)
+			}
+		}
+
+		n, f, err := (redisCodec{}).reply([]byte(reply + "+OK\r\n"))
+
+		if n != len(reply) || f != failure || err != nil {
+			t.Errorf("Wrong reply %q: %d %q %v", reply, n, f, err)
+		}
+	}
+}
+
+func TestForwardRedis(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan []string, 10)
+
+	// Replies +OK to everything but BAD
+	go func() {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+
+		for {
+			args, err := readTestCommand(reader)
+
+			if err != nil {
+				return
+			}
+
+			received <- args
+
+			if args[0] == "BAD" {
+				conn.Write([]byte("-ERR unknown command 'BAD'\r\n"))
+			} else {
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+
+	settings := ReplaySettings{ForwardAddress: "redis://" + ln.Addr().String(), ForwardDropCommands: "FLUSHALL", ForwardCommands: CommandOptions{RewriteKeys: "=staging:"}}
+	hosts, err := settings.ForwardedHosts()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	factory := NewRequestFactory(hosts, false)
+	defer factory.Close()
+
+	meta := MessageMeta{ClientIP: "10.0.0.1", ClientPort: 51234, FirstPacket: time.Now()}
+	factory.AddTCPMessage(meta, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*1\r\n$8\r\nFLUSHALL\r\nBAD\r\n"))
+
+	for _, expected := range [][]string{{"GET", "staging:a"}, {"BAD"}} {
+		select {
+		case args := <-received:
+			if len(args) != len(expected) || args[0] != expected[0] || args[len(args)-1] != expected[len(expected)-1] {
+				t.Error("Wrong command", args)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Command not received", expected)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		totals := factory.summary.HostTotals(hosts[0])
+
+		if len(totals.Commands) == 2 {
+			if totals.Commands["GET"].Count != 1 || totals.Commands["BAD"].Errors != 1 || totals.DroppedCommands != 1 {
+				t.Error("Wrong command totals", totals.Commands, totals.DroppedCommands)
+			}
+
+			var errors []*RequestError
+
+			factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+				errors = factory.errors
+				return hosts
+			})
+
+			if len(errors) != 1 || errors[0].Error != "ERR unknown command 'BAD'" || errors[0].Client != "10.0.0.1" {
+				t.Error("Error reply should be recorded", errors)
+			}
+
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Error("Replies not counted")
+}
+
+// readTestCommand reads RESP array of bulk strings, or inline command
+func readTestCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := r.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	data := []byte(line)
+
+	for {
+		commands, n, err := (redisCodec{}).parse(data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if n > 0 {
+			for _, arg := range commands[0].args {
+				args = append(args, string(arg))
+			}
+
+			return args, nil
+		}
+
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, line...)
+	}
+}
@@ -22,22 +22,54 @@
 //
 //     gor replay -h
 //
+//
+// Embedding
+//
+// Replay server can be embedded into other programs:
+//
+//     server, err := replay.NewServer(replay.ReplaySettings{Address: "127.0.0.1:28020", ForwardAddress: "http://staging.server"})
+//     if err != nil {
+//         return err
+//     }
+//     err = server.Run(ctx) // Returns when ctx cancelled and in-flight requests finished
+//
+// Server created by NewStandalone does not listen for connections, messages captured in the same process
+// are passed to its Handle method.
+//
 package replay
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
-const bufSize = 4096
+// Listener closes connection after sending message, connections open longer are dropped
+const readTimeout = 30 * time.Second
+
+// Used if DrainTimeout setting is 0
+const defaultDrainTimeout = 5 * time.Second
 
-// Debug enables logging only if "--verbose" flag passed
-func Debug(v ...interface{}) {
-	if Settings.Verbose {
+// Used if MaxMessageSize setting is 0
+const defaultMaxMessageSize = 64 << 20
+
+// ErrMessageSize returned when message from listener is larger than MaxMessageSize
+var ErrMessageSize = errors.New("message is larger than max message size")
+
+// ErrDrainTimeout returned by Run if in-flight requests was not finished during drain timeout
+var ErrDrainTimeout = errors.New("drain timeout exceeded, some requests was not finished")
+
+// debug enables logging only if "--verbose" flag passed
+func debug(verbose bool, v ...interface{}) {
+	if verbose {
 		log.Println(v...)
 	}
 }
@@ -51,71 +83,393 @@ func ParseRequest(data []byte) (request *http.Request, err error) {
 	return
 }
 
-// Run acts as `main` function of replay
-// Replay server listen to UDP traffic from Listeners
-// Each request processed by RequestFactory
-func Run() {
-	listener, err := net.Listen("tcp", Settings.Address)
+// ParseRequests returns all requests message contains
+//
+// Requests sent back-to-back on keep-alive connection (pipelining) are captured by listener as one message.
+// Bodies are read into memory. On error, e.g. truncated body of the last request, complete requests
+// parsed before it are returned too.
+func ParseRequests(data []byte) (requests []*http.Request, err error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	for {
+		request, err := http.ReadRequest(reader)
+
+		if err != nil {
+			return requests, err
+		}
+
+		body, err := io.ReadAll(request.Body)
+
+		if err != nil {
+			return requests, err
+		}
+
+		if len(body) == 0 {
+			request.Body = http.NoBody
+		} else {
+			request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		requests = append(requests, request)
+
+		// Empty lines between requests are ignored, https://tools.ietf.org/html/rfc7230#section-3.5
+		for {
+			b, err := reader.ReadByte()
+
+			if err == io.EOF {
+				return requests, nil
+			}
+
+			if b != '\r' && b != '\n' {
+				reader.UnreadByte()
+				break
+			}
+		}
+	}
+}
+
+// Server receives requests from Listeners and passes them to RequestFactory
+type Server struct {
+	settings ReplaySettings
+
+	listener net.Listener
+	factory  *RequestFactory
+	nonces   *authNonces
+
+	drainStarted time.Time // Set by DrainFrom, DrainTimeout counted from cancellation if zero
+}
+
+// NewServer starts listening on settings.Address (or Host:Port if Address is empty)
+func NewServer(settings ReplaySettings) (server *Server, err error) {
+	if settings.Address == "" {
+		settings.SetAddress()
+	}
+
+	if server, err = NewStandalone(settings); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", settings.Address)
+
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	if settings.TLSCert != "" {
+		config, err := settings.tlsConfig()
+
+		if err != nil {
+			listener.Close()
+			server.Close()
+			return nil, err
+		}
 
-	log.Println("Starting replay server at:", Settings.Address)
+		listener = tls.NewListener(listener, config)
+	}
+
+	server.listener = listener
+
+	return
+}
+
+// NewStandalone creates server which does not accept connections from listeners.
+// Messages captured in the same process are passed to Handle instead, network settings are ignored.
+func NewStandalone(settings ReplaySettings) (server *Server, err error) {
+	if settings.DrainTimeout == 0 {
+		settings.DrainTimeout = defaultDrainTimeout
+	}
+
+	if settings.MaxMessageSize == 0 {
+		settings.MaxMessageSize = defaultMaxMessageSize
+	}
+
+	if settings.AdminAddress != "" && settings.AdminToken == "" && !isLoopback(settings.AdminAddress) {
+		return nil, ErrAdminToken
+	}
+
+	if err = settings.Affinity.Validate(); err != nil {
+		return nil, err
+	}
+
+	hosts, err := settings.ForwardedHosts()
 
 	if err != nil {
-		log.Fatal("Can't start:", err)
+		return nil, err
+	}
+
+	server = &Server{settings: settings, nonces: newAuthNonces()}
+	server.factory = NewRequestFactory(hosts, settings.Verbose)
+
+	if settings.DryRun {
+		if server.factory.dryRun, err = newDryRun(settings.DryRunOutput); err != nil {
+			server.factory.Close()
+			return nil, err
+		}
+
+		log.Println("Dry run: requests are printed instead of sending to forward hosts")
 	}
+	server.factory.SetAffinity(settings.Affinity, settings.AffinityWindow)
 
-	for _, host := range Settings.ForwardedHosts() {
-		log.Println("Forwarding requests to:", host.Url, "limit:", host.Limit)
+	return
+}
+
+// Close stops processing requests and closes dry run output
+//
+// Run closes server when it stops, Close is needed only if server created but not run.
+func (s *Server) Close() {
+	s.factory.Close()
+
+	if s.factory.dryRun != nil {
+		s.factory.dryRun.Close()
 	}
+}
 
-	requestFactory := NewRequestFactory()
+// DrainFrom makes Run count DrainTimeout from given time instead of its cancellation.
+// Should be called before Run context cancelled.
+func (s *Server) DrainFrom(started time.Time) {
+	s.drainStarted = started
+}
+
+// Addr returns address server listening on, nil for standalone server
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Addr()
+}
+
+// Reload replaces forward hosts and client affinity with ones from given settings, without dropping in-flight requests
+//
+// Stats of hosts which remain in settings are preserved. Other settings require restart.
+func (s *Server) Reload(settings ReplaySettings) error {
+	if err := settings.Affinity.Validate(); err != nil {
+		return err
+	}
+
+	hosts, err := settings.ForwardedHosts()
+
+	if err != nil {
+		return err
+	}
+
+	s.factory.SetHosts(hosts)
+	s.factory.SetAffinity(settings.Affinity, settings.AffinityWindow)
+
+	return nil
+}
+
+// Summary returns totals for the whole run
+func (s *Server) Summary() *Summary {
+	return s.factory.summary
+}
+
+// Run accepts connections from Listeners until ctx cancelled
+// Each request processed by RequestFactory
+//
+// After cancellation it stops accepting connections and waits for in-flight requests.
+// Standalone server only waits for cancellation, Handle should not be called after it.
+// Returns ErrDrainTimeout if it took longer than DrainTimeout setting.
+func (s *Server) Run(ctx context.Context) error {
+	if s.listener != nil {
+		log.Println("Starting replay server at:", s.Addr())
+	}
+
+	var admin *http.Server
+
+	if s.settings.AdminAddress != "" {
+		admin = &http.Server{Addr: s.settings.AdminAddress, Handler: s.AdminHandler()}
+
+		log.Println("Starting admin API at:", s.settings.AdminAddress)
+
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				log.Println("Admin API error:", err)
+			}
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		log.Println("Stopping replay server, draining in-flight requests")
+
+		if s.listener != nil {
+			s.listener.Close()
+		}
+
+		if admin != nil {
+			admin.Close()
+		}
+	}()
+
+	var connections sync.WaitGroup
+
+	if s.listener == nil {
+		<-ctx.Done()
+		return s.drain(&connections)
+	}
 
 	for {
-		conn, err := listener.Accept()
+		conn, err := s.listener.Accept()
 
 		if err != nil {
+			if ctx.Err() != nil {
+				return s.drain(&connections)
+			}
+
 			log.Println("Error while Accept()", err)
 			continue
 		}
 
-		go handleConnection(conn, requestFactory)
+		connections.Add(1)
+
+		go func() {
+			s.handleConnection(conn)
+			connections.Done()
+		}()
 	}
 
 }
 
-func handleConnection(conn net.Conn, rf *RequestFactory) error {
+// drain waits for accepted connections and forwarded requests, but no longer than DrainTimeout setting.
+// Requests not finished in time are abandoned.
+func (s *Server) drain(connections *sync.WaitGroup) (err error) {
+	started := s.drainStarted
+
+	if started.IsZero() {
+		started = time.Now()
+	}
+
+	deadline := started.Add(s.settings.DrainTimeout)
+
+	if !waitTimeout(connections, time.Until(deadline)) || !waitTimeout(&s.factory.inFlight, time.Until(deadline)) {
+		err = ErrDrainTimeout
+	}
+
+	s.Close()
+	s.factory.summary.Finish()
+
+	return
+}
+
+// waitTimeout returns false if WaitGroup not finished in given time
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan bool)
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	}
+
+	// Finished right at the deadline
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) error {
 	defer conn.Close()
 
-	var read = true
-	var response []byte
-	var buf []byte
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Client which never completes handshake should not hold connection forever
+		conn.SetDeadline(time.Now().Add(readTimeout))
 
-	buf = make([]byte, bufSize)
+		if err := tlsConn.Handshake(); err != nil {
+			s.factory.summary.IncRejected()
+			log.Println("Rejected connection from", conn.RemoteAddr(), "TLS handshake failed:", err)
+			return err
+		}
+	}
 
-	for read {
-		n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
 
-		switch err {
-		case io.EOF:
-			read = false
-		case nil:
-			response = append(response, buf[:n]...)
-			if n < bufSize {
-				read = false
-			}
-		default:
-			read = false
+	reader := bufio.NewReader(conn)
+
+	var auth *authLine
+	var err error
+
+	if s.settings.AuthSecret != "" {
+		if auth, err = readAuthLine(reader); err != nil {
+			s.factory.summary.IncRejected()
+			log.Println("Rejected connection from", conn.RemoteAddr(), err)
+			return err
 		}
 	}
 
-	go func() {
-		if request, err := ParseRequest(response); err != nil {
-			Debug("Error while parsing request", err, response)
-		} else {
-			Debug("Adding request", request)
+	response, err := io.ReadAll(io.LimitReader(reader, int64(s.settings.MaxMessageSize)+1))
+
+	if err != nil {
+		log.Println("Error while reading message from", conn.RemoteAddr(), err)
+		return err
+	}
 
-			rf.Add(request)
+	if len(response) > s.settings.MaxMessageSize {
+		s.factory.summary.IncRejected()
+		log.Println("Rejected connection from", conn.RemoteAddr(), ErrMessageSize)
+		return ErrMessageSize
+	}
+
+	if auth != nil {
+		if err = s.settings.verifyAuth(auth, response, s.nonces); err != nil {
+			s.factory.summary.IncRejected()
+			log.Println("Rejected connection from", conn.RemoteAddr(), err)
+			return err
 		}
-	}()
+	}
+
+	meta, response := parseMeta(response)
+
+	s.Handle(meta, response)
 
 	return nil
 }
+
+// Handle passes message captured by listener to RequestFactory, message is HTTP requests, WebSocket frame or raw TCP data depending on meta.Proto
+//
+// Server calls it for each message received from listeners, standalone server gets messages only from Handle.
+// It is safe to call from multiple goroutines.
+func (s *Server) Handle(meta MessageMeta, message []byte) {
+	if meta.Proto == "tcp" {
+		s.factory.summary.IncReceived()
+
+		debug(s.settings.Verbose, "Adding TCP message", meta)
+
+		s.factory.AddTCPMessage(meta, message)
+		return
+	}
+
+	if meta.Proto == "websocket" {
+		debug(s.settings.Verbose, "Adding WebSocket frame", meta)
+
+		s.factory.AddFrame(meta, message)
+		return
+	}
+
+	requests, err := ParseRequests(message)
+
+	for _, request := range requests {
+		s.factory.summary.IncReceived()
+
+		debug(s.settings.Verbose, "Adding request", meta, request)
+
+		s.factory.Add(withMeta(request, meta))
+	}
+
+	if err != nil {
+		s.factory.summary.IncParseError()
+		debug(s.settings.Verbose, "Error while parsing request", err, message)
+	}
+}
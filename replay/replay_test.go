@@ -0,0 +1,250 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipelined returns n requests written back-to-back, odd ones with body
+func pipelined(n int) (data string) {
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			data += "GET /" + strconv.Itoa(i) + " HTTP/1.1\r\nHost: www.w3.org\r\n\r\n"
+		} else {
+			body := "a=" + strconv.Itoa(i) + "&b=2"
+			data += "POST /" + strconv.Itoa(i) + " HTTP/1.1\r\nHost: www.w3.org\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+		}
+	}
+
+	return
+}
+
+func TestParseRequests(t *testing.T) {
+	for n := 1; n <= 10; n++ {
+		requests, err := ParseRequests([]byte(pipelined(n)))
+
+		if err != nil || len(requests) != n {
+			t.Fatal("All pipelined requests should be parsed", n, len(requests), err)
+		}
+
+		for i, request := range requests {
+			body, _ := io.ReadAll(request.Body)
+
+			if request.URL.Path != "/"+strconv.Itoa(i) {
+				t.Error("Wrong request order", n, i, request.URL)
+			}
+
+			if i%2 == 1 && string(body) != "a="+strconv.Itoa(i)+"&b=2" {
+				t.Error("Wrong body", n, i, string(body))
+			}
+		}
+	}
+
+	// Clients may send empty line after body
+	requests, err := ParseRequests([]byte("POST / HTTP/1.1\r\nContent-Length: 3\r\n\r\na=1\r\nGET / HTTP/1.1\r\n\r\n\r\n"))
+
+	if err != nil || len(requests) != 2 {
+		t.Error("Empty lines between requests should be ignored", len(requests), err)
+	}
+
+	requests, err = ParseRequests([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\na=1\r\n0\r\n\r\n" + pipelined(2)))
+
+	if err != nil || len(requests) != 3 {
+		t.Error("Chunked request should be followed by next one", len(requests), err)
+	}
+
+	requests, err = ParseRequests([]byte(pipelined(2) + "garbage\r\n\r\n"))
+
+	if err == nil || len(requests) != 2 {
+		t.Error("Requests before malformed data should be returned with error", len(requests), err)
+	}
+
+	requests, err = ParseRequests([]byte(pipelined(2) + "POST /2 HTTP/1.1\r\nContent-Length: 10\r\n\r\na=1"))
+
+	if err == nil || len(requests) != 2 {
+		t.Error("Complete requests before truncated body should be returned with error", len(requests), err)
+	}
+}
+
+func TestRunZeroDrainTimeout(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		server, err := NewServer(ReplaySettings{Address: "127.0.0.1:0", ForwardAddress: "http://127.0.0.1:1"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := server.Run(ctx); err != nil {
+			t.Fatal("Nothing was in flight, default drain timeout should be used", err)
+		}
+	}
+}
+
+func TestDrainFrom(t *testing.T) {
+	release := make(chan bool)
+	forward := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer forward.Close()
+	defer close(release)
+
+	server, err := NewStandalone(ReplaySettings{ForwardAddress: forward.URL, DrainTimeout: time.Second})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Handle(MessageMeta{}, []byte("GET / HTTP/1.1\r\nHost: svc\r\n\r\n"))
+
+	// Drain time was already spent, e.g. by listener in standalone mode
+	server.DrainFrom(time.Now().Add(-time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+
+	if err := server.Run(ctx); err != ErrDrainTimeout || time.Since(start) > 500*time.Millisecond {
+		t.Error("Drain timeout should be counted from given time", err, time.Since(start))
+	}
+}
+
+func TestServerPipelined(t *testing.T) {
+	received := make(chan *http.Request, 20)
+
+	forward := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if r.Method == "POST" && !strings.HasPrefix(string(body), "a=") {
+			t.Error("Body should be forwarded", r.URL, string(body))
+		}
+
+		received <- r
+	}))
+	defer forward.Close()
+
+	server, err := NewServer(ReplaySettings{Address: "127.0.0.1:0", ForwardAddress: forward.URL})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go server.Run(ctx)
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte(pipelined(10)))
+	conn.Close()
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("All pipelined requests should be forwarded", i)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	server, err := NewStandalone(ReplaySettings{ForwardAddress: "http://127.0.0.1:1", MaxMessageSize: 10})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, message := range []string{"GET / HTTP/1.1\r\n\r\n", "GET /\r\n"} {
+		client, conn := net.Pipe()
+
+		go func() {
+			client.Write([]byte(message))
+			client.Close()
+		}()
+
+		err := server.handleConnection(conn)
+
+		if len(message) > 10 && err != ErrMessageSize {
+			t.Error("Message larger than MaxMessageSize should be rejected", err)
+		}
+
+		if len(message) <= 10 && err != nil {
+			t.Error("Message within MaxMessageSize should be accepted", err)
+		}
+	}
+
+	if rejected := server.Summary().Rejected; rejected != 1 {
+		t.Error("Rejected message should be counted", rejected)
+	}
+}
+
+func TestChunkedForward(t *testing.T) {
+	type forwarded struct {
+		transferEncoding []string
+		contentLength    int64
+		body             string
+		checksum         string // Trailer or header
+	}
+
+	received := make(chan forwarded, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		checksum := r.Trailer.Get("X-Checksum")
+		if checksum == "" {
+			checksum = r.Header.Get("X-Checksum")
+		}
+
+		received <- forwarded{r.TransferEncoding, r.ContentLength, string(body), checksum}
+	}))
+	defer server.Close()
+
+	message := "POST /upload HTTP/1.1\r\nHost: www.w3.org\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+		"3\r\nabc\r\n5\r\nhello\r\n0\r\nX-Checksum: 42\r\n\r\n"
+
+	for _, dechunk := range []bool{false, true} {
+		settings := ReplaySettings{ForwardAddress: server.URL, ForwardHeaders: HeaderOptions{Dechunk: dechunk}}
+		hosts, _ := settings.ForwardedHosts()
+		factory := NewRequestFactory(hosts, false)
+
+		requests, err := ParseRequests([]byte(message))
+
+		if err != nil || len(requests) != 1 {
+			t.Fatal("Chunked request should be parsed", err)
+		}
+
+		factory.Add(requests[0])
+		r := <-received
+		factory.inFlight.Wait()
+		factory.Close()
+
+		if r.body != "abchello" || r.checksum != "42" {
+			t.Error("Body and trailer should be forwarded", dechunk, r)
+		}
+
+		if dechunk && (len(r.transferEncoding) != 0 || r.contentLength != 8) {
+			t.Error("Body should be sent with Content-Length", r)
+		}
+
+		if !dechunk && (len(r.transferEncoding) != 1 || r.transferEncoding[0] != "chunked") {
+			t.Error("Body should be sent chunked", r)
+		}
+	}
+}
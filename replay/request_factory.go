@@ -1,18 +1,27 @@
 package replay
 
 import (
-	"errors"
+	"bytes"
+	"io"
+	"log"
 	"net/http"
-	"net/url"
+	"sync"
+	"time"
 )
 
 // HttpResponse contains a host, a http request,
-// a http response and an error
+// a http response, an error, time elapsed waiting for response and number of followed redirects
 type HttpResponse struct {
-	host *ForwardHost
-	req  *http.Request
-	resp *http.Response
-	err  error
+	host      *ForwardHost
+	req       *http.Request
+	resp      *http.Response
+	err       error
+	elapsed   time.Duration
+	redirects int // Redirects followed
+
+	session *session // Set if request sent in client order
+
+	grpc *grpcResult // Set for gRPC calls
 }
 
 // RequestFactory processes requests
@@ -26,79 +35,333 @@ type HttpResponse struct {
 type RequestFactory struct {
 	c_responses chan *HttpResponse
 	c_requests  chan *http.Request
+	c_commands  chan func(hosts []*ForwardHost) []*ForwardHost
+	c_replies   chan *commandReply // Replies of redis:// and memcached:// hosts
+	c_close     chan bool
+
+	hosts []*ForwardHost // Initial hosts, after start hosts are owned by handleRequests()
+
+	summary *Summary // Totals for the whole run
+
+	errors []*RequestError // Recent request errors, owned by handleRequests()
+
+	// Ordering of requests by client, owned by handleRequests()
+	affinity       Affinity
+	affinityWindow time.Duration
+	sessions       map[sessionKey]*session
+	c_dispatch     chan *session // Session reorder window passed
+
+	// Cookies set by hosts, see cookies.go. Owned by handleRequests()
+	jars        map[jarKey]*cookieJar
+	jarsExpired time.Time
+
+	// WebSocket and TCP connections of clients, see stream.go. Owned by handleRequests()
+	streams map[streamKey]*stream
+
+	inFlight sync.WaitGroup // Requests added but not yet responded, and stream chunks not yet sent
+
+	dryRun *dryRun // Requests are printed instead of sending, set before first request
+
+	verbose bool
 }
 
 // NewRequestFactory returns a RequestFactory pointer
 // One created, it starts listening for incoming requests: requests channel
-func NewRequestFactory() (factory *RequestFactory) {
-	factory = &RequestFactory{}
+func NewRequestFactory(hosts []*ForwardHost, verbose bool) (factory *RequestFactory) {
+	factory = &RequestFactory{hosts: hosts, verbose: verbose}
+	factory.summary = NewSummary()
 	factory.c_responses = make(chan *HttpResponse)
 	factory.c_requests = make(chan *http.Request)
+	factory.c_commands = make(chan func(hosts []*ForwardHost) []*ForwardHost)
+	factory.c_replies = make(chan *commandReply)
+	factory.c_close = make(chan bool)
+	factory.c_dispatch = make(chan *session)
+	factory.sessions = make(map[sessionKey]*session)
+	factory.jars = make(map[jarKey]*cookieJar)
+	factory.streams = make(map[streamKey]*stream)
 
 	go factory.handleRequests()
 
 	return
 }
 
-// customCheckRedirect disables redirects https://github.com/buger/gor/pull/15
-func customCheckRedirect(req *http.Request, via []*http.Request) error {
-	if len(via) >= 0 {
-		return errors.New("stopped after 2 redirects")
+// sendRequest forwards http request to a given host
+func (f *RequestFactory) sendRequest(host *ForwardHost, request *http.Request, s *session) {
+	// Change HOST of original request
+	request.RequestURI = ""
+	request.URL = host.forwardURL(request.URL)
+	host.Headers.apply(request)
+
+	debug(f.verbose, "Sending request:", host.Url, request)
+
+	if f.dryRun != nil {
+		f.dryRun.request(host, request)
+		f.respond(&HttpResponse{host: host, req: request, session: s})
+		return
+	}
+
+	redirects := 0
+	request = withRedirectsCounter(request, &redirects)
+
+	var grpc *grpcResult
+
+	start := time.Now()
+	resp, err := host.client.Do(request)
+
+	if err == nil && isGRPC(request) {
+		grpc = readGRPCResult(request, resp)
 	}
-	return nil
+
+	elapsed := time.Since(start)
+
+	// Connection of accepted WebSocket upgrade is used by session replay
+	if err == nil && !(host.WebSocket && resp.StatusCode == http.StatusSwitchingProtocols) {
+		defer resp.Body.Close()
+	} else if err != nil {
+		debug(f.verbose, "Request error:", err)
+	}
+
+	f.respond(&HttpResponse{host, request, resp, err, elapsed, redirects, s, grpc})
 }
 
-// sendRequest forwards http request to a given host
-func (f *RequestFactory) sendRequest(host *ForwardHost, request *http.Request) {
-	client := &http.Client{
-		CheckRedirect: customCheckRedirect,
+// respond passes response to handleRequests(), it is dropped if factory closed
+func (f *RequestFactory) respond(resp *HttpResponse) {
+	select {
+	case f.c_responses <- resp:
+	case <-f.c_close:
+		if resp.resp != nil {
+			resp.resp.Body.Close()
+		}
 	}
+}
 
-	// Change HOST of original request
-	URL := host.Url + request.URL.Path + "?" + request.URL.RawQuery
+// send request to host in background, state owned by handleRequests() applied right before sending
+func (f *RequestFactory) send(host *ForwardHost, request *http.Request, s *session) {
+	f.mapCookies(host, request)
 
-	request.RequestURI = ""
-	request.URL, _ = url.ParseRequestURI(URL)
+	if host.WebSocket && isWebSocketUpgrade(request) {
+		f.startWebSocket(host, request)
+	}
+
+	go f.sendRequest(host, request, s)
+}
 
-	Debug("Sending request:", host.Url, request)
+// cloneRequest returns copy of request with own re-readable body, so it can be modified and sent independently
+func cloneRequest(request *http.Request, body []byte) *http.Request {
+	clone := request.Clone(request.Context())
 
-	resp, err := client.Do(request)
+	if len(body) == 0 {
+		clone.Body = http.NoBody
+		clone.GetBody = nil
+		return clone
+	}
 
-	if err == nil {
-		defer resp.Body.Close()
-	} else {
-		Debug("Request error:", err)
+	clone.ContentLength = int64(len(body))
+	clone.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
 	}
+	clone.Body, _ = clone.GetBody()
 
-	f.c_responses <- &HttpResponse{host, request, resp, err}
+	return clone
 }
 
 // handleRequests and their responses
 func (f *RequestFactory) handleRequests() {
-	hosts := Settings.ForwardedHosts()
+	hosts := f.swapHosts(nil, f.hosts)
 
 	for {
 		select {
 		case req := <-f.c_requests:
+			// Body buffered once, and each host gets own copy of request
+			body, err := io.ReadAll(req.Body)
+
+			if err != nil {
+				debug(f.verbose, "Error while reading request body:", err)
+				f.summary.IncParseError()
+				f.inFlight.Done()
+				continue
+			}
+
+			meta := Meta(req)
+			client := f.affinity.clientKey(req)
+
+			if client != "" {
+				req = withClient(req, client)
+			} else {
+				req = withClient(req, meta.ClientIP)
+			}
+
 			for _, host := range hosts {
+				// Requests from other clients are routed to other hosts
+				if host.isTCP() || !host.accepts(meta) || !host.acceptsCall(req) {
+					continue
+				}
+
 				// Ensure that we have actual stats for given timestamp
 				host.Stat.Touch()
 
-				if host.Limit == 0 || host.Stat.Count < host.Limit {
+				if host.Paused {
+					f.summary.IncDropped(host)
+				} else if host.Limit == 0 || host.Stat.Count < host.Limit {
 					// Increment Stat.Count
 					host.Stat.IncReq()
+					host.Stat.Pending++
+					f.summary.IncForwarded(host)
+					f.inFlight.Add(1)
 
-					go f.sendRequest(host, req)
+					if client != "" {
+						f.enqueue(host, client, cloneRequest(req, body))
+					} else {
+						f.send(host, cloneRequest(req, body), nil)
+					}
+				} else {
+					f.summary.IncDropped(host)
 				}
 			}
+
+			f.inFlight.Done()
 		case resp := <-f.c_responses:
+			// Cookies set by host are used by next requests of the same client
+			f.observeCookies(resp)
+
+			if resp.host.WebSocket && isWebSocketUpgrade(resp.req) {
+				f.openWebSocket(resp)
+			}
+
 			// Increment returned http code stats, and elapsed time
 			resp.host.Stat.IncResp(resp)
+			resp.host.Stat.Pending--
+			f.summary.IncResp(resp)
+			f.inFlight.Done()
+
+			if resp.err != nil {
+				f.addError(resp)
+			} else if resp.grpc != nil && resp.grpc.failed() {
+				f.recordError(resp.host, resp.req.URL.String(), Meta(resp.req).ClientIP, resp.grpc.err())
+			}
+
+			// Next request of the same client can be sent now
+			if resp.session != nil {
+				f.next(resp.session)
+			}
+
+			if resp.host.removed && resp.host.Stat.Pending == 0 {
+				log.Println("Removed host drained:", resp.host.Url)
+				resp.host.closeIdleConnections()
+			}
+		case reply := <-f.c_replies:
+			f.handleReply(reply)
+		case s := <-f.c_dispatch:
+			s.scheduled = false
+			f.next(s)
+		case command := <-f.c_commands:
+			hosts = command(hosts)
+		case <-f.c_close:
+			return
+		}
+	}
+}
+
+// swapHosts replaces current hosts with new ones
+//
+// Hosts with same Url keep their stats. Requests already sent to removed hosts are still waited and counted.
+func (f *RequestFactory) swapHosts(hosts []*ForwardHost, newHosts []*ForwardHost) []*ForwardHost {
+	current := make(map[string]*ForwardHost)
+
+	for _, host := range hosts {
+		current[host.Url] = host
+	}
+
+	for _, host := range newHosts {
+		if old, ok := current[host.Url]; ok {
+			host.Stat = old.Stat
+			host.Stat.host = host
+			delete(current, host.Url)
+
+			// In-flight requests of replaced host are still counted via new one
+			if old != host {
+				old.closeIdleConnections()
+			}
+		}
+
+		// Keep hosts in summary even if they never receive a request
+		f.summary.Host(host)
+
+		log.Println("Forwarding requests to:", host.Url, "limit:", host.Limit)
+	}
+
+	for _, host := range current {
+		host.removed = true
+
+		log.Println("Removed host:", host.Url, "in-flight requests:", host.Stat.Pending)
+
+		if host.Stat.Pending == 0 {
+			host.closeIdleConnections()
 		}
 	}
+
+	return newHosts
+}
+
+// SetHosts atomically replaces hosts requests forwarded to
+func (f *RequestFactory) SetHosts(newHosts []*ForwardHost) {
+	f.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		return f.swapHosts(hosts, newHosts)
+	})
+}
+
+// Do runs command inside request processing loop, so it can safely read and modify hosts and their stats
+// Hosts returned by command replace current ones. Do returns after command finished.
+func (f *RequestFactory) Do(command func(hosts []*ForwardHost) []*ForwardHost) {
+	done := make(chan bool)
+
+	wrapped := func(hosts []*ForwardHost) []*ForwardHost {
+		defer close(done)
+		return command(hosts)
+	}
+
+	select {
+	case f.c_commands <- wrapped:
+		<-done
+	case <-f.c_close:
+	}
+}
+
+// RequestError describes failed request, recent errors available via admin API
+type RequestError struct {
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	URL    string    `json:"url"`
+	Client string    `json:"client"` // Original client IP, empty if unknown
+	Error  string    `json:"error"`
+}
+
+const maxRecentErrors = 100
+
+func (f *RequestFactory) addError(resp *HttpResponse) {
+	f.recordError(resp.host, resp.req.URL.String(), Meta(resp.req).ClientIP, resp.err)
+}
+
+func (f *RequestFactory) recordError(host *ForwardHost, url string, client string, err error) {
+	f.errors = append(f.errors, &RequestError{time.Now(), host.Url, url, client, err.Error()})
+
+	if len(f.errors) > maxRecentErrors {
+		f.errors = f.errors[len(f.errors)-maxRecentErrors:]
+	}
+}
+
+// Close stops processing requests. Requests not finished yet are abandoned, and requests added later are dropped.
+func (f *RequestFactory) Close() {
+	close(f.c_close)
 }
 
 // Add request to channel for further processing
 func (f *RequestFactory) Add(request *http.Request) {
-	f.c_requests <- request
+	f.inFlight.Add(1)
+
+	select {
+	case f.c_requests <- request:
+	case <-f.c_close:
+		f.inFlight.Done()
+	}
 }
@@ -11,9 +11,17 @@ type RequestStat struct {
 	Codes map[int]int // { 200: 10, 404:2, 500:1 }
 
 	Count  int // All requests including errors
-	Errors int // Requests with errors (timeout or host not reachable). Not include 50x errors.
+	Errors int // Requests with errors (timeout or host not reachable) and failed gRPC calls. Not include 50x errors.
+
+	Redirects int // Redirects followed
+
+	Commands map[string]int // Replies by command of redis:// and memcached:// hosts, or by gRPC method { "GET": 10, "SET": 2 }
+
+	Pending int // Requests sent (or queued by client affinity) but not yet responded, not reset every second
 
 	host *ForwardHost
+
+	verbose bool
 }
 
 // Touch ensures that current stats is actual (for current timestamp)
@@ -32,31 +40,59 @@ func (s *RequestStat) IncReq() {
 func (s *RequestStat) IncResp(resp *HttpResponse) {
 	s.Touch()
 
+	s.Redirects += resp.redirects
+
 	if resp.err != nil {
 		s.Errors++
 		return
 	}
 
+	// Not sent in dry run
+	if resp.resp == nil {
+		return
+	}
+
 	s.Codes[resp.resp.StatusCode]++
+
+	if resp.grpc != nil {
+		s.Commands[resp.grpc.method]++
+
+		if resp.grpc.failed() {
+			s.Errors++
+		}
+	}
+}
+
+// IncCommand is called after reply to command
+func (s *RequestStat) IncCommand(reply *commandReply) {
+	s.Touch()
+
+	s.Commands[reply.name]++
+
+	if reply.err != nil {
+		s.Errors++
+	}
 }
 
 // reset updates stats timestamp to current time and reset to zero all stats values
 // TODO: Further on reset it should write stats to file
 func (s *RequestStat) reset() {
 	if s.timestamp != 0 {
-		Debug("Host:", s.host.Url, "Requests:", s.Count, "Errors:", s.Errors, "Status codes:", s.Codes)
+		debug(s.verbose, "Host:", s.host.Url, "Requests:", s.Count, "Errors:", s.Errors, "Redirects:", s.Redirects, "Status codes:", s.Codes, "Commands:", s.Commands)
 	}
 
 	s.timestamp = time.Now().Unix()
 
 	s.Codes = make(map[int]int)
+	s.Commands = make(map[string]int)
 	s.Count = 0
 	s.Errors = 0
+	s.Redirects = 0
 }
 
 // NewRequestStats returns a RequestStat pointer
-func NewRequestStats(host *ForwardHost) (stat *RequestStat) {
-	stat = &RequestStat{host: host}
+func NewRequestStats(host *ForwardHost, verbose bool) (stat *RequestStat) {
+	stat = &RequestStat{host: host, verbose: verbose}
 	stat.reset()
 
 	return
@@ -1,10 +1,15 @@
 package replay
 
 import (
+	"errors"
 	"flag"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ForwardHost where to forward requests
@@ -12,7 +17,63 @@ type ForwardHost struct {
 	Url   string
 	Limit int
 
+	Paused bool // Requests to paused host are dropped
+
+	TLS ForwardTLS // Used for https:// hosts
+
+	Redirects RedirectPolicy
+
+	Headers HeaderOptions
+
+	Clients []string // Only requests from these client IPs or networks (10.0.0.0/8) are forwarded, all if empty
+
+	MapCookies bool // Replace production cookies by ones set by host, see cookies.go
+
+	HTTP2 bool // Forward requests over HTTP/2, without TLS (h2c) for http:// hosts
+
+	WebSocket bool // Replay WebSocket sessions after upgrade, see websocket.go
+
+	Commands CommandOptions // Used for redis:// and memcached:// hosts
+
+	GRPCMethods []string // Only gRPC calls of these services or methods (pkg.Service, pkg.Service/Method) are forwarded, all if empty
+
 	Stat *RequestStat
+
+	client  *http.Client
+	base    *url.URL     // Parsed Url, its path used as prefix for forwarded requests
+	clients []*net.IPNet // Parsed Clients
+	grpc    bool         // Only gRPC calls forwarded, set for grpc:// and grpcs:// hosts
+
+	removed bool // Host removed from settings on reload, but may still have in-flight requests
+}
+
+// forwardURL returns URL of original request pointed to host
+//
+// Path escaping, query (even empty one) and fragment are kept as is. If host Url has a path,
+// it used as a prefix: http://staging/api + /users?id=1 = http://staging/api/users?id=1
+func (h *ForwardHost) forwardURL(original *url.URL) *url.URL {
+	u := *original
+
+	u.Scheme = h.base.Scheme
+	u.Host = h.base.Host
+	u.User = h.base.User
+
+	if prefix := strings.TrimRight(h.base.Path, "/"); prefix != "" {
+		u.Path = prefix + original.Path
+
+		if original.RawPath != "" || h.base.RawPath != "" {
+			u.RawPath = strings.TrimRight(h.base.EscapedPath(), "/") + original.EscapedPath()
+		}
+	}
+
+	return &u
+}
+
+// closeIdleConnections of host own transport, default transport shared with other hosts is not touched
+func (h *ForwardHost) closeIdleConnections() {
+	if h.client != nil && h.client.Transport != nil {
+		h.client.CloseIdleConnections()
+	}
 }
 
 // ReplaySettings ListenerSettings contain all the needed configuration for setting up the replay
@@ -23,61 +84,260 @@ type ReplaySettings struct {
 	Address        string
 	ForwardAddress string
 
+	Hosts []*ForwardHost // Forward hosts defined in config file, used in addition to ForwardAddress
+
+	ForwardTLS ForwardTLS // TLS options for hosts from ForwardAddress
+
+	ForwardRedirects RedirectPolicy // Redirect policy for hosts from ForwardAddress
+	ForwardHeaders   HeaderOptions  // Header options for hosts from ForwardAddress
+	ForwardClients   string         // Comma separated client IPs or networks for hosts from ForwardAddress
+	ForwardCookies   bool           // Map production cookies for hosts from ForwardAddress
+	ForwardHTTP2     bool           // Use HTTP/2 for hosts from ForwardAddress
+	ForwardWebSocket bool           // Replay WebSocket sessions to hosts from ForwardAddress
+
+	ForwardCommands     CommandOptions // Command options for redis:// and memcached:// hosts from ForwardAddress
+	ForwardDropCommands string         // Comma separated commands to drop, for hosts from ForwardAddress
+
+	ForwardGRPCMethods string // Comma separated gRPC services or methods for hosts from ForwardAddress
+
+	Affinity       Affinity      // Send requests of each client in capture order
+	AffinityWindow time.Duration // How long to wait for requests arrived out of order
+
 	Verbose bool
+
+	SummaryPath string // Write run summary as JSON to this file
+
+	DryRun       bool   // Print requests instead of sending them, see dry_run.go
+	DryRunOutput string // Print dry run requests to this file instead of stdout
+
+	DrainTimeout time.Duration // How long to wait for in-flight requests on shutdown, 5s if 0
+
+	AdminAddress string // Address of admin HTTP API, disabled if empty
+	AdminToken   string // Admin API requests should have "Authorization: Bearer <token>" header. Required unless AdminAddress is loopback
+
+	TLSCert     string // Server certificate, enables TLS for connections from listeners
+	TLSKey      string
+	TLSClientCA string // CA bundle to verify listeners certificates (mutual TLS)
+
+	AuthSecret string // Shared secret, listeners should sign messages with it
+
+	MaxMessageSize int // Larger messages from listeners are rejected, 64MB if 0
 }
 
+// Settings populated from command line flags when gor started in "replay" or "standalone" mode
 var Settings ReplaySettings = ReplaySettings{}
 
 // ForwardedHosts implements forwardAddress syntax support for multiple hosts (coma separated), and rate limiting by specifing "|maxRps" after host name.
 //
 //    -f "host1,http://host2|10,host3"
 //
-func (r *ReplaySettings) ForwardedHosts() (hosts []*ForwardHost) {
+// Hosts from config file are added after them. Each call returns new hosts with empty stats.
+// Error returned if TLS options of some host are invalid.
+func (r *ReplaySettings) ForwardedHosts() (hosts []*ForwardHost, err error) {
 	hosts = make([]*ForwardHost, 0, 10)
 
-	for _, address := range strings.Split(r.ForwardAddress, ",") {
-		host_info := strings.Split(address, "|")
+	if r.ForwardAddress != "" {
+		for _, address := range strings.Split(r.ForwardAddress, ",") {
+			host_info := strings.Split(address, "|")
+
+			host := &ForwardHost{Url: host_info[0], TLS: r.ForwardTLS, Redirects: r.ForwardRedirects, Headers: r.ForwardHeaders, MapCookies: r.ForwardCookies, HTTP2: r.ForwardHTTP2, WebSocket: r.ForwardWebSocket}
+
+			if r.ForwardClients != "" {
+				host.Clients = strings.Split(r.ForwardClients, ",")
+			}
 
-		if strings.Index(host_info[0], "http") == -1 {
-			host_info[0] = "http://" + host_info[0]
+			host.Commands = r.ForwardCommands
+
+			if r.ForwardDropCommands != "" {
+				host.Commands.Drop = strings.Split(r.ForwardDropCommands, ",")
+			}
+
+			if r.ForwardGRPCMethods != "" {
+				host.GRPCMethods = strings.Split(r.ForwardGRPCMethods, ",")
+			}
+
+			if len(host_info) > 1 {
+				host.Limit, _ = strconv.Atoi(host_info[1])
+			}
+
+			hosts = append(hosts, host)
+		}
+	}
+
+	for _, h := range r.Hosts {
+		host := *h
+		hosts = append(hosts, &host)
+	}
+
+	for _, host := range hosts {
+		if !strings.Contains(host.Url, "://") {
+			host.Url = "http://" + host.Url
 		}
 
-		host := &ForwardHost{Url: host_info[0]}
-		host.Stat = NewRequestStats(host)
+		host.Stat = NewRequestStats(host, r.Verbose)
 
-		if len(host_info) > 1 {
-			host.Limit, _ = strconv.Atoi(host_info[1])
+		if host.base, err = url.Parse(host.Url); err != nil || host.base.Host == "" {
+			return nil, errors.New(host.Url + ": invalid url")
 		}
 
-		hosts = append(hosts, host)
+		if host.clients, err = parseNetworks(host.Clients); err != nil {
+			return nil, errors.New(host.Url + ": " + err.Error())
+		}
+
+		host.grpcScheme()
+
+		// Raw TCP hosts don't need HTTP client
+		if host.isTCP() {
+			if err = host.Commands.Validate(); err != nil {
+				return nil, errors.New(host.Url + ": " + err.Error())
+			}
+
+			continue
+		}
+
+		var transport http.RoundTripper
+
+		if host.HTTP2 {
+			transport, err = host.http2Transport()
+		} else {
+			transport, err = host.TLS.transport()
+		}
+
+		if err != nil {
+			return nil, errors.New(host.Url + ": " + err.Error())
+		}
+
+		host.client = &http.Client{Transport: transport, CheckRedirect: host.Redirects.checkRedirect}
 	}
 
 	return
 }
 
+// parseNetworks accepts CIDR networks and single IPs
+func parseNetworks(networks []string) (parsed []*net.IPNet, err error) {
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, ipNet)
+	}
+
+	return
+}
+
+// accepts returns true if request with given meta should be forwarded to host
+func (host *ForwardHost) accepts(meta MessageMeta) bool {
+	if len(host.clients) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(meta.ClientIP)
+
+	for _, network := range host.clients {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // SetAddress with port, e.g.: 127.0.0.1:28020
 func (r *ReplaySettings) SetAddress() {
 	r.Address = r.Host + ":" + strconv.Itoa(r.Port)
 }
 
 func init() {
-	if len(os.Args) < 2 || os.Args[1] != "replay" {
+	if len(os.Args) < 2 || (os.Args[1] != "replay" && os.Args[1] != "standalone") {
 		return
 	}
 
+	RegisterFlags(flag.CommandLine, &Settings, os.Args[1] == "standalone")
+}
+
+// RegisterFlags defines command line flags of replay mode bound to given settings, and sets them to defaults.
+// In standalone mode messages are not received from listeners, so flags of that connection are not defined.
+func RegisterFlags(flags *flag.FlagSet, settings *ReplaySettings, standalone bool) {
 	const (
 		defaultPort = 28020
 		defaultHost = "0.0.0.0"
 
 		defaultForwardAddress = "http://localhost:8080"
+
+		defaultAffinityWindow = 100 * time.Millisecond
 	)
 
-	flag.IntVar(&Settings.Port, "p", defaultPort, "specify port number")
+	flags.StringVar(&settings.ForwardAddress, "f", defaultForwardAddress, "http address to forward traffic.\n\tYou can limit requests per second by adding `|num` after address.\n\tIf you have multiple addresses with different limits. For example: http://staging.example.com|100,http://dev.example.com|10")
+
+	flags.BoolVar(&settings.Verbose, "verbose", false, "Log requests")
+
+	flags.StringVar(&settings.SummaryPath, "summary", "", "write run summary as JSON to given file on shutdown")
+
+	flags.BoolVar(&settings.DryRun, "dry-run", false, "process requests as usual, but print them instead of sending to forward hosts")
+	flags.StringVar(&settings.DryRunOutput, "dry-run-output", "", "write dry run requests to given file instead of stdout")
+
+	flags.DurationVar(&settings.DrainTimeout, "drain-timeout", defaultDrainTimeout, "on shutdown wait this long for in-flight requests")
+
+	flags.BoolVar(&settings.ForwardTLS.InsecureSkipVerify, "forward-tls-insecure", false, "do not verify certificates of https forward hosts")
+	flags.StringVar(&settings.ForwardTLS.CA, "forward-tls-ca", "", "CA certificates file to verify https forward hosts")
+	flags.StringVar(&settings.ForwardTLS.Cert, "forward-tls-cert", "", "client certificate file for https forward hosts")
+	flags.StringVar(&settings.ForwardTLS.Key, "forward-tls-key", "", "client certificate key file for https forward hosts")
+	flags.StringVar(&settings.ForwardTLS.ServerName, "forward-tls-server-name", "", "server name (SNI) used for https forward hosts instead of their host name")
+
+	flags.IntVar(&settings.ForwardRedirects.Max, "forward-redirects", 0, "follow up to given number of redirects, by default redirects are not followed")
+	flags.BoolVar(&settings.ForwardRedirects.SameHost, "forward-redirects-same-host", false, "follow only redirects to the same host")
+
+	flags.BoolVar(&settings.ForwardHeaders.RewriteHost, "forward-rewrite-host", false, "set Host header to forward host, by default original Host is kept")
+	flags.BoolVar(&settings.ForwardHeaders.MarkReplayed, "forward-mark-replayed", false, "add \"X-Gor-Replayed: 1\" header to forwarded requests")
+	flags.BoolVar(&settings.ForwardHeaders.Dechunk, "forward-dechunk", false, "send chunked request bodies with Content-Length")
+	flags.BoolVar(&settings.ForwardHeaders.Forwarded, "forward-x-forwarded", false, "add X-Forwarded-For with original client IP and X-Forwarded-Host with original Host")
+
+	flags.StringVar(&settings.ForwardClients, "forward-clients", "", "forward only requests from given client IPs or networks, comma separated. For example: 10.0.0.0/8,192.168.1.5")
+
+	flags.BoolVar(&settings.ForwardHTTP2, "forward-http2", false, "forward requests over HTTP/2, h2c with prior knowledge for http:// hosts")
+
+	flags.BoolVar(&settings.ForwardWebSocket, "forward-websocket", false, "replay client frames of WebSocket connections with original timing")
+
+	flags.StringVar(&settings.ForwardDropCommands, "forward-drop-commands", "", "commands not replayed to redis:// and memcached:// hosts, comma separated. @write drops all writes. For example: FLUSHALL,DEL")
+	flags.StringVar(&settings.ForwardCommands.RewriteKeys, "forward-rewrite-keys", "", "replace key prefix of commands replayed to redis:// and memcached:// hosts, \"from=to\". For example: prod:=staging:")
+
+	flags.StringVar(&settings.ForwardGRPCMethods, "forward-grpc-methods", "", "forward only gRPC calls of given services or methods, comma separated. For example: shop.Cart,shop.Orders/Get")
+
+	flags.BoolVar(&settings.ForwardCookies, "forward-map-cookies", false, "replace production cookies of each client by ones set by forward host responses")
+
+	flags.StringVar((*string)(&settings.Affinity), "affinity", "", "send requests of each client one by one in capture order. Client defined by: ip, cookie:<name> or header:<name>")
+	flags.DurationVar(&settings.AffinityWindow, "affinity-window", defaultAffinityWindow, "how long to wait for client requests arrived out of order")
+
+	flags.StringVar(&settings.AdminAddress, "admin", "", "address of admin HTTP API to manage forward hosts, e.g. localhost:28021")
+	flags.StringVar(&settings.AdminToken, "admin-token", "", "admin API requests should have \"Authorization: Bearer <token>\" header, required if admin API is not on loopback address")
+
+	// In standalone mode "-p" and "-ip" are capture flags of listener package
+	if standalone {
+		return
+	}
+
+	flags.IntVar(&settings.Port, "p", defaultPort, "specify port number")
+
+	flags.StringVar(&settings.Host, "ip", defaultHost, "ip addresses to listen on")
 
-	flag.StringVar(&Settings.Host, "ip", defaultHost, "ip addresses to listen on")
+	flags.StringVar(&settings.TLSCert, "tls-cert", "", "certificate file, enables TLS for connections from listeners")
+	flags.StringVar(&settings.TLSKey, "tls-key", "", "certificate key file")
+	flags.StringVar(&settings.TLSClientCA, "tls-client-ca", "", "CA certificates file, listeners should present certificate signed by it")
 
-	Settings.SetAddress()
-	flag.StringVar(&Settings.ForwardAddress, "f", defaultForwardAddress, "http address to forward traffic.\n\tYou can limit requests per second by adding `|num` after address.\n\tIf you have multiple addresses with different limits. For example: http://staging.example.com|100,http://dev.example.com|10")
+	flags.StringVar(&settings.AuthSecret, "auth-secret", "", "shared secret, messages from listeners without valid signature are rejected")
 
-	flag.BoolVar(&Settings.Verbose, "verbose", false, "Log requests")
+	flags.IntVar(&settings.MaxMessageSize, "max-message-size", defaultMaxMessageSize, "messages from listeners larger than this number of bytes are rejected")
 }
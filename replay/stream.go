@@ -0,0 +1,218 @@
+package replay
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Streams replay data of client connection (WebSocket frames or raw TCP messages) with original timing:
+// data captured 2s after connection start is sent 2s after replayed connection opened.
+// Data sent back by host is read and discarded, or matched to commands, see commands.go.
+
+// Streams without data to send for this time are closed
+const streamIdleTimeout = 5 * time.Minute
+
+// streamKey identifies client connection replayed to host
+type streamKey struct {
+	host   string
+	client string // ip:port
+}
+
+func newStreamKey(host *ForwardHost, meta MessageMeta) streamKey {
+	return streamKey{host.Url, net.JoinHostPort(meta.ClientIP, strconv.Itoa(meta.ClientPort))}
+}
+
+type streamChunk struct {
+	data     []byte
+	captured time.Time
+}
+
+// stream holds data of one client connection. Created by handleRequests(), data sent by replayStream()
+type stream struct {
+	captured time.Time // When connection started
+
+	frames bool // Chunks are WebSocket frames, counted in summary
+
+	commands *commandStream // Set for redis:// and memcached:// hosts, chunks are parsed into commands
+
+	mu        sync.Mutex
+	queue     []streamChunk // Sorted by capture time
+	discarded bool          // Stream finished, new chunks are not queued
+
+	pending *sync.WaitGroup // Queued chunks are counted until sent, so drain waits for them
+
+	c_notify chan bool // New chunk queued
+}
+
+func newStream(captured time.Time, pending *sync.WaitGroup) *stream {
+	return &stream{captured: captured, pending: pending, c_notify: make(chan bool, 1)}
+}
+
+// push queues chunk, chunks can arrive from listener out of order
+func (s *stream) push(chunk streamChunk) {
+	s.mu.Lock()
+
+	if s.discarded {
+		s.mu.Unlock()
+		return
+	}
+
+	s.pending.Add(1)
+
+	i := sort.Search(len(s.queue), func(i int) bool { return s.queue[i].captured.After(chunk.captured) })
+	s.queue = append(s.queue, streamChunk{})
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = chunk
+	s.mu.Unlock()
+
+	select {
+	case s.c_notify <- true:
+	default:
+	}
+}
+
+// head returns earliest queued chunk
+func (s *stream) head() (chunk streamChunk, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return chunk, false
+	}
+
+	return s.queue[0], true
+}
+
+// pop removes earliest chunk from queue, it is still pending until sent
+func (s *stream) pop() {
+	s.mu.Lock()
+	s.queue = s.queue[1:]
+	s.mu.Unlock()
+}
+
+// discard drops queued chunks of finished stream
+func (s *stream) discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.discarded {
+		return
+	}
+
+	s.discarded = true
+
+	for range s.queue {
+		s.pending.Done()
+	}
+
+	s.queue = nil
+}
+
+// replayStream sends queued chunks to host with original timing until stream closed
+func (f *RequestFactory) replayStream(host *ForwardHost, key streamKey, s *stream, conn io.ReadWriteCloser) {
+	opened := time.Now()
+	closed := make(chan bool)
+
+	go func() {
+		if s.commands != nil {
+			f.readReplies(host, s.commands, conn)
+		} else {
+			io.Copy(io.Discard, conn)
+		}
+
+		close(closed)
+	}()
+
+	defer func() {
+		conn.Close()
+		s.discard()
+		f.removeStream(key, s)
+	}()
+
+	for {
+		var wait <-chan time.Time
+		var timer *time.Timer
+
+		if chunk, ok := s.head(); ok {
+			delay := time.Until(opened.Add(chunk.captured.Sub(s.captured)))
+
+			if delay <= 0 {
+				s.pop()
+				sent := f.sendChunk(host, s, conn, chunk.data)
+				s.pending.Done()
+
+				if !sent {
+					return
+				}
+
+				continue
+			}
+
+			timer = time.NewTimer(delay)
+			wait = timer.C
+		} else {
+			wait = time.After(streamIdleTimeout)
+		}
+
+		select {
+		case <-wait:
+			// Idle stream closed, otherwise head chunk is due
+			if _, ok := s.head(); !ok {
+				return
+			}
+		case <-s.c_notify:
+		case <-closed:
+			return
+		case <-f.c_close:
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// sendChunk writes chunk data to host, returns false if connection failed
+func (f *RequestFactory) sendChunk(host *ForwardHost, s *stream, conn io.Writer, data []byte) bool {
+	if s.commands != nil {
+		var dropped int
+		var err error
+
+		if data, dropped, err = s.commands.write(data); err != nil {
+			debug(f.verbose, "Error while parsing commands:", host.Url, err)
+		}
+
+		f.summary.IncDroppedCommands(host, dropped)
+
+		if len(data) == 0 {
+			return true
+		}
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		debug(f.verbose, "Error while sending stream data:", host.Url, err)
+		return false
+	}
+
+	if s.frames {
+		f.summary.IncFrames(host)
+	}
+
+	return true
+}
+
+// removeStream forgets finished stream, so next data of the client starts new one
+func (f *RequestFactory) removeStream(key streamKey, s *stream) {
+	f.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		if f.streams[key] == s {
+			delete(f.streams, key)
+		}
+
+		return hosts
+	})
+}
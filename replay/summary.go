@@ -0,0 +1,420 @@
+package replay
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Summary accumulates totals for the whole replay run
+//
+// Unlike RequestStat, which is reset every second, Summary is never reset and
+// is reported once when replay server stops.
+type Summary struct {
+	mu sync.Mutex
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	Received    int `json:"received"`     // Requests received from listeners
+	ParseErrors int `json:"parse_errors"` // Messages that can't be parsed as http request
+	Rejected    int `json:"rejected"`     // Connections from listeners failed TLS, authentication or size check
+
+	Hosts []*HostSummary `json:"hosts"`
+}
+
+// HostSummary contains totals for a single forward host
+type HostSummary struct {
+	Url string `json:"url"`
+
+	Forwarded int `json:"forwarded"` // Requests sent to host
+	Dropped   int `json:"dropped"`   // Requests skipped because of rate limit
+	Redirects int `json:"redirects"` // Redirects followed
+	Frames    int `json:"frames"`    // WebSocket frames sent
+
+	Codes  map[int]int    `json:"codes"`  // { 200: 10, 404:2, 500:1 }
+	Errors map[string]int `json:"errors"` // { "timeout": 2, "connection refused": 1 }
+
+	Latency LatencyStats `json:"latency"`
+
+	// Replayed commands of redis:// and memcached:// hosts, or gRPC calls by method
+	Commands        map[string]*CommandSummary `json:"commands,omitempty"`
+	DroppedCommands int                        `json:"dropped_commands"` // Commands skipped by drop list
+
+	latencies latencyHistogram
+}
+
+// CommandSummary contains totals for a single command or gRPC method
+type CommandSummary struct {
+	Count  int `json:"count"`
+	Errors int `json:"errors"` // Error replies, or calls with non-zero grpc-status
+
+	Latency LatencyStats `json:"latency"`
+
+	latencies latencyHistogram
+}
+
+// LatencyStats holds response time percentiles in milliseconds
+type LatencyStats struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// NewSummary returns a Summary pointer with started time set to now
+func NewSummary() *Summary {
+	return &Summary{Started: time.Now()}
+}
+
+// Host returns totals for given forward host, creating them if needed
+func (s *Summary) Host(host *ForwardHost) *HostSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.host(host.Url)
+}
+
+func (s *Summary) host(url string) *HostSummary {
+	for _, h := range s.Hosts {
+		if h.Url == url {
+			return h
+		}
+	}
+
+	h := &HostSummary{
+		Url:    url,
+		Codes:  make(map[int]int),
+		Errors: make(map[string]int),
+	}
+	s.Hosts = append(s.Hosts, h)
+
+	return h
+}
+
+// HostTotals returns copy of totals for given host, with latency calculated for the moment
+func (s *Summary) HostTotals(host *ForwardHost) (totals HostSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.host(host.Url)
+
+	totals = *h
+	totals.Latency = h.latencies.stats()
+	totals.Codes = make(map[int]int)
+	totals.Errors = make(map[string]int)
+
+	for code, count := range h.Codes {
+		totals.Codes[code] = count
+	}
+
+	for category, count := range h.Errors {
+		totals.Errors[category] = count
+	}
+
+	if h.Commands != nil {
+		totals.Commands = make(map[string]*CommandSummary)
+
+		for name, c := range h.Commands {
+			totals.Commands[name] = &CommandSummary{Count: c.Count, Errors: c.Errors, Latency: c.latencies.stats()}
+		}
+	}
+
+	return
+}
+
+// IncReceived is called for each message received from listener
+func (s *Summary) IncReceived() {
+	s.mu.Lock()
+	s.Received++
+	s.mu.Unlock()
+}
+
+// IncRejected is called when listener connection failed TLS handshake, authentication or size check
+func (s *Summary) IncRejected() {
+	s.mu.Lock()
+	s.Rejected++
+	s.mu.Unlock()
+}
+
+// IncParseError is called when message can't be parsed as http request
+func (s *Summary) IncParseError() {
+	s.mu.Lock()
+	s.ParseErrors++
+	s.mu.Unlock()
+}
+
+// IncForwarded is called when request sent to host
+func (s *Summary) IncForwarded(host *ForwardHost) {
+	s.mu.Lock()
+	s.host(host.Url).Forwarded++
+	s.mu.Unlock()
+}
+
+// IncDropped is called when request skipped because of host rate limit
+func (s *Summary) IncDropped(host *ForwardHost) {
+	s.mu.Lock()
+	s.host(host.Url).Dropped++
+	s.mu.Unlock()
+}
+
+// IncFrames is called when WebSocket frame sent to host
+func (s *Summary) IncFrames(host *ForwardHost) {
+	s.mu.Lock()
+	s.host(host.Url).Frames++
+	s.mu.Unlock()
+}
+
+// IncError records category of error not related to a request, e.g. failed TCP connection
+func (s *Summary) IncError(host *ForwardHost, err error) {
+	s.mu.Lock()
+	s.host(host.Url).Errors[errorCategory(err)]++
+	s.mu.Unlock()
+}
+
+// IncDroppedCommands is called when commands skipped by drop list
+func (s *Summary) IncDroppedCommands(host *ForwardHost, count int) {
+	if count == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	s.host(host.Url).DroppedCommands += count
+	s.mu.Unlock()
+}
+
+// IncCommand records reply to command and elapsed time
+func (s *Summary) IncCommand(reply *commandReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.host(reply.host.Url).incCommand(reply.name, reply.elapsed, reply.err != nil)
+}
+
+func (h *HostSummary) incCommand(name string, elapsed time.Duration, failed bool) {
+	if h.Commands == nil {
+		h.Commands = make(map[string]*CommandSummary)
+	}
+
+	c, ok := h.Commands[name]
+
+	if !ok {
+		c = &CommandSummary{}
+		h.Commands[name] = c
+	}
+
+	c.Count++
+	c.latencies.add(elapsed)
+
+	if failed {
+		c.Errors++
+	}
+}
+
+// IncResp records response code or error category, and elapsed time
+func (s *Summary) IncResp(resp *HttpResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.host(resp.host.Url)
+	h.Redirects += resp.redirects
+
+	if resp.err != nil {
+		h.Errors[errorCategory(resp.err)]++
+		return
+	}
+
+	// Not sent in dry run
+	if resp.resp == nil {
+		return
+	}
+
+	h.Codes[resp.resp.StatusCode]++
+	h.latencies.add(resp.elapsed)
+
+	if resp.grpc != nil {
+		h.incCommand(resp.grpc.method, resp.elapsed, resp.grpc.failed())
+	}
+}
+
+// Finish marks end of the run and calculates latency percentiles
+func (s *Summary) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Finished = time.Now()
+
+	for _, h := range s.Hosts {
+		h.Latency = h.latencies.stats()
+
+		for _, c := range h.Commands {
+			c.Latency = c.latencies.stats()
+		}
+	}
+}
+
+// Print writes human readable report
+func (s *Summary) Print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintln(w, "Replay summary")
+	fmt.Fprintln(w, "  Duration:", s.Finished.Sub(s.Started))
+	fmt.Fprintln(w, "  Received from listeners:", s.Received)
+	fmt.Fprintln(w, "  Parse errors:", s.ParseErrors)
+	fmt.Fprintln(w, "  Rejected connections:", s.Rejected)
+
+	for _, h := range s.Hosts {
+		fmt.Fprintln(w, "Host:", h.Url)
+		fmt.Fprintln(w, "  Forwarded:", h.Forwarded, "Dropped:", h.Dropped, "Redirects followed:", h.Redirects, "WebSocket frames:", h.Frames)
+		fmt.Fprintln(w, "  Status codes:", h.Codes)
+		fmt.Fprintln(w, "  Errors:", h.Errors)
+		fmt.Fprintf(w, "  Latency ms: p50=%.1f p90=%.1f p95=%.1f p99=%.1f max=%.1f\n",
+			h.Latency.P50, h.Latency.P90, h.Latency.P95, h.Latency.P99, h.Latency.Max)
+
+		if h.Commands == nil {
+			continue
+		}
+
+		if h.DroppedCommands > 0 {
+			fmt.Fprintln(w, "  Dropped commands:", h.DroppedCommands)
+		}
+
+		names := make([]string, 0, len(h.Commands))
+
+		for name := range h.Commands {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			c := h.Commands[name]
+			fmt.Fprintf(w, "  %s: count=%d errors=%d latency ms: p50=%.1f p99=%.1f max=%.1f\n",
+				name, c.Count, c.Errors, c.Latency.P50, c.Latency.P99, c.Latency.Max)
+		}
+	}
+}
+
+// WriteJSON writes report to given file
+func (s *Summary) WriteJSON(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// Report prints summary to stdout, and writes it as JSON if jsonPath is not empty
+func (s *Summary) Report(jsonPath string) {
+	s.Print(os.Stdout)
+
+	if jsonPath != "" {
+		if err := s.WriteJSON(jsonPath); err != nil {
+			fmt.Println("Can't write summary:", err)
+		}
+	}
+}
+
+// errorCategory groups request errors into small set of categories
+func errorCategory(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &certErr), errors.As(err, &recordErr):
+		return "tls"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+
+	return "other"
+}
+
+// Latencies are counted in buckets growing exponentially from latencyMinBucket, so percentiles are
+// accurate to 5% and memory does not grow with run length. Last bucket holds everything above ~10 minutes.
+const (
+	latencyMinBucket    = 100 * time.Microsecond
+	latencyBucketGrowth = 1.05
+	latencyBuckets      = 320
+)
+
+// latencyHistogram counts latencies by buckets, max is kept exactly
+type latencyHistogram struct {
+	counts [latencyBuckets]int
+	total  int
+	max    time.Duration
+}
+
+// latencyBucket returns index of bucket with upper bound not less than d
+func latencyBucket(d time.Duration) int {
+	if d <= latencyMinBucket {
+		return 0
+	}
+
+	i := int(math.Ceil(math.Log(float64(d)/float64(latencyMinBucket)) / math.Log(latencyBucketGrowth)))
+
+	return min(i, latencyBuckets-1)
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	h.counts[latencyBucket(d)]++
+	h.total++
+	h.max = max(h.max, d)
+}
+
+// stats returns percentiles as upper bounds of their buckets, but not above max
+func (h *latencyHistogram) stats() (stats LatencyStats) {
+	if h.total == 0 {
+		return
+	}
+
+	milliseconds := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	percentile := func(p float64) float64 {
+		rank := int(p*float64(h.total-1)) + 1
+		seen := 0
+
+		for i, count := range h.counts {
+			if seen += count; seen >= rank && i < latencyBuckets-1 {
+				bound := time.Duration(float64(latencyMinBucket) * math.Pow(latencyBucketGrowth, float64(i)))
+				return milliseconds(min(bound, h.max))
+			}
+		}
+
+		return milliseconds(h.max)
+	}
+
+	stats.P50 = percentile(0.50)
+	stats.P90 = percentile(0.90)
+	stats.P95 = percentile(0.95)
+	stats.P99 = percentile(0.99)
+	stats.Max = milliseconds(h.max)
+
+	return
+}
@@ -0,0 +1,43 @@
+package replay
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSummaryLatency(t *testing.T) {
+	host := &ForwardHost{Url: "http://localhost"}
+	summary := NewSummary()
+
+	for i := 1; i <= 100; i++ {
+		resp := &HttpResponse{host: host, resp: &http.Response{StatusCode: 200}, elapsed: time.Duration(i) * time.Millisecond}
+		summary.IncResp(resp)
+	}
+
+	summary.IncResp(&HttpResponse{host: host, err: errors.New("boom")})
+	summary.Finish()
+
+	h := summary.Host(host)
+
+	if h.Codes[200] != 100 {
+		t.Error("Should count status codes", h.Codes)
+	}
+
+	if h.Errors["other"] != 1 {
+		t.Error("Should count errors by category", h.Errors)
+	}
+
+	// Percentiles are approximate, but not less than actual and not more than 5% above
+	if h.Latency.P50 < 50 || h.Latency.P50 > 52.5 || h.Latency.P99 < 99 || h.Latency.P99 > 100 || h.Latency.Max != 100 {
+		t.Error("Wrong latency percentiles", h.Latency)
+	}
+
+	slow := &ForwardHost{Url: "http://slow"}
+	summary.IncResp(&HttpResponse{host: slow, resp: &http.Response{StatusCode: 200}, elapsed: time.Hour})
+
+	if latency := summary.HostTotals(slow).Latency; latency.P50 != 3600000 || latency.Max != 3600000 {
+		t.Error("Latency above last bucket should be reported as max", latency)
+	}
+}
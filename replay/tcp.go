@@ -0,0 +1,95 @@
+package replay
+
+import (
+	"net"
+	"time"
+)
+
+// Raw TCP replay
+//
+// Listener started with "-protocol tcp" sends captured client data as is, with "proto=tcp" meta.
+// Such data forwarded only to tcp://, redis:// and memcached:// hosts: for each client connection replay server
+// opens connection to host and writes data with original timing, see stream.go. Data sent to redis:// and
+// memcached:// hosts is parsed into commands, see commands.go. HTTP requests are not forwarded to these hosts.
+//
+// Since data of stream can't be skipped, host limit and pause apply to new client connections only.
+
+// Timeout for connecting to tcp:// hosts
+const tcpDialTimeout = 5 * time.Second
+
+// isTCP returns true if host receives raw TCP data instead of HTTP requests
+func (h *ForwardHost) isTCP() bool {
+	return h.base.Scheme == "tcp" || h.codec() != nil
+}
+
+// AddTCPMessage queues data received from listener to streams of its client, opening them if needed
+func (f *RequestFactory) AddTCPMessage(meta MessageMeta, data []byte) {
+	chunk := streamChunk{data, meta.FirstPacket}
+
+	f.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		for _, host := range hosts {
+			if !host.isTCP() || !host.accepts(meta) {
+				continue
+			}
+
+			// Ensure that we have actual stats for given timestamp
+			host.Stat.Touch()
+
+			key := newStreamKey(host, meta)
+			s, ok := f.streams[key]
+
+			if !ok {
+				if host.Paused || (host.Limit != 0 && host.Stat.Count >= host.Limit) {
+					f.summary.IncDropped(host)
+					continue
+				}
+
+				s = newStream(meta.FirstPacket, &f.inFlight)
+				f.streams[key] = s
+
+				if host.codec() != nil {
+					s.commands = newCommandStream(host, meta.ClientIP)
+					s.commands.dryRun = f.dryRun != nil
+				}
+
+				go f.dialStream(host, key, s, meta)
+			}
+
+			host.Stat.IncReq()
+			f.summary.IncForwarded(host)
+
+			s.push(chunk)
+		}
+
+		return hosts
+	})
+}
+
+// dialStream connects to host and replays stream
+func (f *RequestFactory) dialStream(host *ForwardHost, key streamKey, s *stream, meta MessageMeta) {
+	if f.dryRun != nil {
+		f.replayStream(host, key, s, f.dryRun.conn(host, meta.ClientIP))
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", host.base.Host, tcpDialTimeout)
+
+	if err != nil {
+		debug(f.verbose, "Error while connecting to:", host.Url, err)
+
+		f.Do(func(hosts []*ForwardHost) []*ForwardHost {
+			host.Stat.Touch()
+			host.Stat.Errors++
+			f.summary.IncError(host, err)
+			f.recordError(host, host.Url, meta.ClientIP, err)
+
+			return hosts
+		})
+
+		s.discard()
+		f.removeStream(key, s)
+		return
+	}
+
+	f.replayStream(host, key, s, conn)
+}
@@ -0,0 +1,222 @@
+package replay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardTCP(t *testing.T) {
+	type received struct {
+		data  string
+		after time.Duration // Since connection opened
+	}
+
+	chunks := make(chan received, 10)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				opened := time.Now()
+				buf := make([]byte, 1024)
+
+				for {
+					n, err := conn.Read(buf)
+
+					if err != nil {
+						return
+					}
+
+					chunks <- received{string(buf[:n]), time.Since(opened)}
+					conn.Write([]byte("+OK\r\n"))
+				}
+			}()
+		}
+	}()
+
+	httpRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpRequests++
+	}))
+	defer server.Close()
+
+	settings := ReplaySettings{ForwardAddress: "tcp://" + ln.Addr().String() + "," + server.URL}
+	hosts, err := settings.ForwardedHosts()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	factory := NewRequestFactory(hosts, false)
+	defer factory.Close()
+
+	start := time.Now().Add(-time.Hour)
+	meta := MessageMeta{ClientIP: "10.0.0.1", ClientPort: 51234, Proto: "tcp"}
+
+	message := func(data string, after time.Duration) {
+		meta.FirstPacket = start.Add(after)
+		meta.LastPacket = meta.FirstPacket
+		factory.AddTCPMessage(meta, []byte(data))
+	}
+
+	// Messages arrive out of order
+	message("*1\r\n$4\r\nPING\r\n", 0)
+	message("*2\r\n$3\r\nGET\r\n$1\r\nb\r\n", 300*time.Millisecond)
+	message("*2\r\n$3\r\nGET\r\n$1\r\na\r\n", 100*time.Millisecond)
+
+	for i, expected := range []string{"PING", "a", "b"} {
+		select {
+		case r := <-chunks:
+			if !strings.Contains(r.data, expected) {
+				t.Error("Wrong data", i, r.data)
+			}
+
+			if i == 2 && r.after < 250*time.Millisecond {
+				t.Error("Data should be sent with original timing", r.after)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Data not received", i)
+		}
+	}
+
+	// HTTP requests are not sent to tcp:// hosts
+	request, _ := ParseRequest([]byte("GET / HTTP/1.1\r\nHost: svc\r\n\r\n"))
+	factory.Add(request)
+	factory.inFlight.Wait()
+
+	if totals := factory.summary.HostTotals(hosts[0]); totals.Forwarded != 3 {
+		t.Error("Wrong tcp host totals", totals.Forwarded)
+	}
+
+	if totals := factory.summary.HostTotals(hosts[1]); totals.Forwarded != 1 || httpRequests != 1 {
+		t.Error("TCP data should not be sent to http hosts", totals.Forwarded, httpRequests)
+	}
+}
+
+func TestForwardTCPError(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	settings := ReplaySettings{ForwardAddress: "tcp://" + addr}
+	hosts, _ := settings.ForwardedHosts()
+	factory := NewRequestFactory(hosts, false)
+	defer factory.Close()
+
+	factory.AddTCPMessage(MessageMeta{ClientIP: "10.0.0.1", ClientPort: 51234}, []byte("PING\r\n"))
+
+	for i := 0; i < 50; i++ {
+		var errors []*RequestError
+
+		factory.Do(func(hosts []*ForwardHost) []*ForwardHost {
+			errors = factory.errors
+			return hosts
+		})
+
+		if len(errors) == 1 {
+			if totals := factory.summary.HostTotals(hosts[0]); totals.Errors["connection refused"] != 1 {
+				t.Error("Error should be counted", totals.Errors)
+			}
+
+			if !waitTimeout(&factory.inFlight, time.Second) {
+				t.Error("Data of failed stream should not be pending")
+			}
+
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Error("Connection error should be recorded")
+}
+
+func TestDrainTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var data []byte
+		buf := make([]byte, 1024)
+
+		for {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := conn.Read(buf)
+			data = append(data, buf[:n]...)
+
+			if err != nil {
+				received <- data
+				return
+			}
+		}
+	}()
+
+	server, err := NewStandalone(ReplaySettings{ForwardAddress: "tcp://" + ln.Addr().String(), DrainTimeout: 5 * time.Second})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- server.Run(ctx)
+	}()
+
+	start := time.Now()
+	meta := MessageMeta{ClientIP: "10.0.0.1", ClientPort: 51234, Proto: "tcp"}
+
+	for i, data := range []string{"first\n", "second\n", "third\n"} {
+		meta.FirstPacket = start.Add(time.Duration(i) * 200 * time.Millisecond)
+		server.Handle(meta, []byte(data))
+	}
+
+	// Cancelled while later data still waits for its time
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatal("Drain should finish in time", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("Run should wait for queued data", elapsed)
+	}
+
+	// Connection is closed when server stops, so everything written is received
+	if data := <-received; string(data) != "first\nsecond\nthird\n" {
+		t.Errorf("All data should be sent before Run returns: %q", data)
+	}
+}
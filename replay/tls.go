@@ -0,0 +1,105 @@
+package replay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// ForwardTLS contains TLS options for https forward host
+type ForwardTLS struct {
+	InsecureSkipVerify bool   // Do not verify host certificate
+	CA                 string // CA bundle to verify host certificate, system roots used if empty
+	Cert               string // Client certificate, if host requires it
+	Key                string
+	ServerName         string // Used for SNI and certificate verification instead of host name
+}
+
+// transport returns http transport for forward host, nil for hosts without TLS options, so they share default transport
+func (t ForwardTLS) transport() (http.RoundTripper, error) {
+	if t == (ForwardTLS{}) {
+		return nil, nil
+	}
+
+	config, err := t.config()
+
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	return transport, nil
+}
+
+// config returns client TLS configuration
+func (t ForwardTLS) config() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		ServerName:         t.ServerName,
+	}
+
+	if t.CA != "" {
+		pool, err := loadCertPool(t.CA)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = pool
+	}
+
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+
+	return pool, nil
+}
+
+// tlsConfig builds TLS configuration for connections from listeners
+//
+// If TLSClientCA set, listeners should present certificate signed by it (mutual TLS).
+func (r *ReplaySettings) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.TLSCert, r.TLSKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if r.TLSClientCA != "" {
+		if config.ClientCAs, err = loadCertPool(r.TLSClientCA); err != nil {
+			return nil, err
+		}
+
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
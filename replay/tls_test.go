@@ -0,0 +1,178 @@
+package replay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert creates certificate signed by parent (self-signed if parent is nil) and writes it to dir
+func testCert(t *testing.T, dir string, name string, parent *tls.Certificate, usage x509.ExtKeyUsage) (cert tls.Certificate, certFile string, keyFile string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, interface{}(key)
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer = parent.Leaf
+		signerKey = parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	cert, _ = tls.LoadX509KeyPair(certFile, keyFile)
+	cert.Leaf, _ = x509.ParseCertificate(der)
+
+	return
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caFile, _ := testCert(t, dir, "ca", nil, x509.ExtKeyUsageAny)
+	_, serverCert, serverKey := testCert(t, dir, "server", &ca, x509.ExtKeyUsageServerAuth)
+	client, _, _ := testCert(t, dir, "client", &ca, x509.ExtKeyUsageClientAuth)
+
+	received := make(chan *http.Request, 10)
+	forward := mockForwardServer(received)
+	defer forward.Close()
+
+	server, err := NewServer(ReplaySettings{
+		Address:        "127.0.0.1:0",
+		ForwardAddress: forward.URL,
+		TLSCert:        serverCert,
+		TLSKey:         serverKey,
+		TLSClientCA:    caFile,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go server.Run(ctx)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	send := func(config *tls.Config) {
+		conn, err := tls.Dial("tcp", server.Addr().String(), config)
+
+		if err != nil {
+			return
+		}
+
+		conn.Write([]byte("GET /test HTTP/1.1\r\nHost: www.w3.org\r\n\r\n"))
+		conn.Close()
+	}
+
+	// Without client certificate
+	send(&tls.Config{RootCAs: roots})
+
+	select {
+	case <-received:
+		t.Error("Listener without certificate should be rejected")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	send(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client}})
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Error("Request from authorized listener should be forwarded")
+	}
+}
+
+func TestForwardTLS(t *testing.T) {
+	forward := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer forward.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: forward.Certificate().Raw}), 0600)
+
+	tests := []struct {
+		name     string
+		tls      ForwardTLS
+		code     int
+		category string
+	}{
+		{"untrusted", ForwardTLS{}, 0, "tls"},
+		{"insecure", ForwardTLS{InsecureSkipVerify: true}, http.StatusAccepted, ""},
+		{"ca", ForwardTLS{CA: caFile}, http.StatusAccepted, ""},
+		{"server name", ForwardTLS{CA: caFile, ServerName: "example.com"}, http.StatusAccepted, ""},
+		{"wrong server name", ForwardTLS{CA: caFile, ServerName: "staging.server"}, 0, "tls"},
+	}
+
+	for _, tt := range tests {
+		settings := ReplaySettings{ForwardAddress: forward.URL, ForwardTLS: tt.tls}
+		hosts, err := settings.ForwardedHosts()
+
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+
+		factory := NewRequestFactory(hosts, false)
+		factory.Add(getRequest())
+		factory.inFlight.Wait()
+
+		totals := factory.summary.HostTotals(hosts[0])
+
+		if tt.code != 0 && totals.Codes[tt.code] != 1 {
+			t.Error(tt.name, "Request should succeed", totals.Codes, totals.Errors)
+		}
+
+		if tt.category != "" && totals.Errors[tt.category] != 1 {
+			t.Error(tt.name, "Request should fail with", tt.category, totals.Errors)
+		}
+
+		factory.Close()
+	}
+
+	settings := ReplaySettings{ForwardAddress: forward.URL, ForwardTLS: ForwardTLS{CA: "missing.crt"}}
+
+	if _, err := settings.ForwardedHosts(); err == nil {
+		t.Error("Missing CA file should be reported")
+	}
+}
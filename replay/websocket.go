@@ -0,0 +1,80 @@
+package replay
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WebSocket replay
+//
+// Listener sends upgrade request as usual, and then each client frame as separate message with "proto=websocket" meta.
+// For hosts with WebSocket option upgrade request opens a stream: once host accepted upgrade, client frames are sent to it
+// with original timing, see stream.go. Frames of clients whose upgrade request was not forwarded are dropped.
+
+// isWebSocketUpgrade returns true if request asks to upgrade connection to WebSocket
+func isWebSocketUpgrade(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Upgrade"), "websocket")
+}
+
+// startWebSocket creates stream for upgrade request sent to host, frames are queued until host accepts upgrade
+func (f *RequestFactory) startWebSocket(host *ForwardHost, request *http.Request) {
+	s := newStream(Meta(request).FirstPacket, &f.inFlight)
+	s.frames = true
+
+	f.streams[newStreamKey(host, Meta(request))] = s
+}
+
+// openWebSocket starts stream replay if host accepted upgrade, called by handleRequests() on upgrade response
+func (f *RequestFactory) openWebSocket(resp *HttpResponse) {
+	key := newStreamKey(resp.host, Meta(resp.req))
+	s, ok := f.streams[key]
+
+	// Upgrade request is not sent in dry run, frames are printed as if host accepted it
+	if f.dryRun != nil {
+		if ok {
+			go f.replayStream(resp.host, key, s, f.dryRun.conn(resp.host, Meta(resp.req).ClientIP))
+		}
+
+		return
+	}
+
+	if resp.err != nil || resp.resp == nil || resp.resp.StatusCode != http.StatusSwitchingProtocols {
+		if ok {
+			s.discard()
+			delete(f.streams, key)
+		}
+
+		return
+	}
+
+	conn, isConn := resp.resp.Body.(io.ReadWriteCloser)
+
+	if !ok || !isConn {
+		resp.resp.Body.Close()
+
+		if ok {
+			s.discard()
+			delete(f.streams, key)
+		}
+
+		return
+	}
+
+	go f.replayStream(resp.host, key, s, conn)
+}
+
+// AddFrame queues WebSocket frame received from listener to streams of its client
+func (f *RequestFactory) AddFrame(meta MessageMeta, data []byte) {
+	chunk := streamChunk{data, meta.LastPacket}
+
+	f.Do(func(hosts []*ForwardHost) []*ForwardHost {
+		for _, host := range hosts {
+			if s, ok := f.streams[newStreamKey(host, meta)]; ok {
+				s.push(chunk)
+			}
+		}
+
+		return hosts
+	})
+}
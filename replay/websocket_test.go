@@ -0,0 +1,124 @@
+package replay
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestForwardWebSocket(t *testing.T) {
+	type received struct {
+		payload string
+		after   time.Duration // Since handshake
+	}
+
+	frames := make(chan received, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+
+		opened := time.Now()
+
+		for {
+			payload, opcode, err := readTestFrame(buf.Reader)
+
+			if err != nil {
+				return
+			}
+
+			frames <- received{payload, time.Since(opened)}
+
+			if opcode == 0x8 {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	settings := ReplaySettings{ForwardAddress: server.URL, ForwardWebSocket: true}
+	hosts, _ := settings.ForwardedHosts()
+	factory := NewRequestFactory(hosts, false)
+	defer factory.Close()
+
+	start := time.Now().Add(-time.Hour)
+	meta := MessageMeta{ClientIP: "10.0.0.1", ClientPort: 51234, FirstPacket: start, LastPacket: start}
+
+	request, _ := ParseRequest([]byte("GET /chat HTTP/1.1\r\nHost: svc\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	factory.Add(withMeta(request, meta))
+
+	// Frames arrive out of order
+	frame := func(opcode byte, payload string, after time.Duration) {
+		meta.FirstPacket = start.Add(after)
+		meta.LastPacket = meta.FirstPacket
+		factory.AddFrame(meta, maskedFrame(opcode, payload))
+	}
+
+	frame(0x1, "second", 300*time.Millisecond)
+	frame(0x1, "first", 100*time.Millisecond)
+	frame(0x8, "", 400*time.Millisecond)
+
+	// Other client
+	meta.ClientPort++
+	frame(0x1, "other", 0)
+
+	for i, expected := range []string{"first", "second", ""} {
+		select {
+		case r := <-frames:
+			if r.payload != expected {
+				t.Error("Wrong frame", i, r.payload)
+			}
+
+			if i == 1 && r.after < 250*time.Millisecond {
+				t.Error("Frame should be sent with original timing", r.after)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Frame not received", i)
+		}
+	}
+
+	factory.inFlight.Wait()
+
+	if totals := factory.summary.HostTotals(hosts[0]); totals.Frames != 3 || totals.Codes[101] != 1 {
+		t.Error("Wrong totals", totals.Frames, totals.Codes)
+	}
+}
+
+func maskedFrame(opcode byte, payload string) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+
+	return frame
+}
+
+// readTestFrame reads short masked frame
+func readTestFrame(r *bufio.Reader) (payload string, opcode byte, err error) {
+	header := make([]byte, 6)
+
+	for i := range header {
+		if header[i], err = r.ReadByte(); err != nil {
+			return
+		}
+	}
+
+	data := make([]byte, header[1]&0x7F)
+
+	for i := range data {
+		if data[i], err = r.ReadByte(); err != nil {
+			return
+		}
+
+		data[i] ^= header[2+i%4]
+	}
+
+	return string(data), header[0] & 0x0F, nil
+}
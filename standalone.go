@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/buger/gor/listener"
+	"github.com/buger/gor/replay"
+)
+
+// Standalone mode runs listener and replay server in one process:
+//
+//     sudo gor standalone -p 80 -f "http://staging.server|10"
+//
+// Captured messages are passed to replay server directly, without network hop, so there is no
+// replay address, TLS or authentication to configure. All replay options work as usual.
+type standalone struct {
+	listener *listener.Listener
+	server   *replay.Server
+}
+
+// newStandalone starts capturing traffic, listener settings for connecting to replay server are ignored
+func newStandalone(listenerSettings listener.ListenerSettings, replaySettings replay.ReplaySettings) (s *standalone, err error) {
+	s = &standalone{}
+
+	if s.server, err = replay.NewStandalone(replaySettings); err != nil {
+		return nil, err
+	}
+
+	listenerSettings.Verbose = replaySettings.Verbose
+	listenerSettings.DrainTimeout = replaySettings.DrainTimeout
+	listenerSettings.Handler = func(meta listener.MessageMeta, data []byte) {
+		s.server.Handle(replayMeta(meta), data)
+	}
+
+	if s.listener, err = listener.New(listenerSettings); err != nil {
+		s.server.Close()
+		return nil, err
+	}
+
+	return
+}
+
+// Run captures and forwards traffic until ctx cancelled
+//
+// Replay server is stopped only after listener drained, so messages captured before cancellation are forwarded.
+// Both drain within one DrainTimeout counted from cancellation.
+func (s *standalone) Run(ctx context.Context) error {
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.server.Run(serverCtx)
+	}()
+
+	stopped := make(chan time.Time, 1)
+	stopWatch := context.AfterFunc(ctx, func() {
+		stopped <- time.Now()
+	})
+
+	err := s.listener.Run(ctx)
+
+	if !stopWatch() {
+		s.server.DrainFrom(<-stopped)
+	}
+
+	stopServer()
+
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+
+	return err
+}
+
+// replayMeta converts meta of captured message into one replay server gets from listeners over network
+func replayMeta(meta listener.MessageMeta) replay.MessageMeta {
+	m := replay.MessageMeta{
+		ClientPort:  meta.ClientPort,
+		ServerPort:  meta.ServerPort,
+		FirstPacket: meta.FirstPacket,
+		LastPacket:  meta.LastPacket,
+		Proto:       meta.Proto,
+	}
+
+	if meta.ClientIP != nil {
+		m.ClientIP = meta.ClientIP.String()
+	}
+
+	if meta.ServerIP != nil {
+		m.ServerIP = meta.ServerIP.String()
+	}
+
+	return m
+}
+
+func runStandalone(ctx context.Context) error {
+	settings := replay.Settings
+	s, err := newStandalone(listener.Settings, settings)
+
+	if err != nil {
+		return err
+	}
+
+	stopReload := reloadOnSignal(s.server)
+	defer stopReload()
+
+	err = s.Run(ctx)
+
+	s.server.Summary().Report(settings.SummaryPath)
+
+	return err
+}